@@ -0,0 +1,162 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// values of the acl-type annotation
+const (
+	// AclTypeWhite only lets the clients of loadBalancerSourceRanges in
+	AclTypeWhite = "white"
+	// AclTypeBlack keeps the clients of loadBalancerSourceRanges out
+	AclTypeBlack = "black"
+
+	aclStatusOn  = "on"
+	aclStatusOff = "off"
+)
+
+// Acl is an access control list of the SLB listeners
+type Acl struct {
+	AclId   string     `json:"aclId"`
+	AclName string     `json:"aclName"`
+	Entries []AclEntry `json:"entries"`
+}
+
+type AclEntry struct {
+	Cidr string `json:"cidr"`
+}
+
+type CreateAclOpts struct {
+	AclName string     `json:"aclName"`
+	Entries []AclEntry `json:"entries"`
+}
+
+// getSourceRanges returns the sorted loadBalancerSourceRanges of service
+func getSourceRanges(service *v1.Service) ([]string, error) {
+	var cidrs []string
+	for _, r := range service.Spec.LoadBalancerSourceRanges {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(r))
+		if err != nil {
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("loadBalancerSourceRanges: %q is not a CIDR", r)}
+		}
+		cidrs = append(cidrs, ipnet.String())
+	}
+	sort.Strings(cidrs)
+	return cidrs, nil
+}
+
+// getAclType returns the acl-type annotation of service
+func getAclType(service *v1.Service) (string, error) {
+	aclType := strings.ToLower(getServiceAnnotation(service, common.ServiceAnnotationLBAclType, AclTypeWhite))
+	if aclType != AclTypeWhite && aclType != AclTypeBlack {
+		return "", &InvalidServiceError{Reason: fmt.Sprintf("annotation %s must be %s or %s, got %q",
+			common.ServiceAnnotationLBAclType, AclTypeWhite, AclTypeBlack, aclType)}
+	}
+	return aclType, nil
+}
+
+// aclName returns the name of the access control list of service
+func aclName(service *v1.Service) string {
+	return fmt.Sprintf("k8s-%s", service.UID)
+}
+
+// aclUrlPre returns the prefix of the ACL API urls
+func (ic *InCloud) aclUrlPre() (string, error) {
+	aclUrlPre := ic.currentConfig().AclUrlPre
+	if aclUrlPre == "" {
+		// not fixed by retrying, reported on the Service
+		return "", &InvalidServiceError{Reason: "cloud config key aclUrl-pre is not set, loadBalancerSourceRanges cannot be enforced"}
+	}
+	return aclUrlPre, nil
+}
+
+// findAcl returns the access control list of service, nil if it has none
+func findAcl(ctx context.Context, config *InCloud, aclUrlPre, token string, service *v1.Service) (*Acl, error) {
+	acls, err := describeAclsByName(ctx, getAPIClient(config), aclUrlPre, token, aclName(service))
+	if err != nil {
+		return nil, err
+	}
+	for i := range acls {
+		if acls[i].AclName == aclName(service) {
+			return &acls[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// EnsureAcl creates the access control list of service, or updates its entries to cidrs
+func EnsureAcl(ctx context.Context, config *InCloud, service *v1.Service, cidrs []string) (*Acl, error) {
+	aclUrlPre, err := config.aclUrlPre()
+	if err != nil {
+		return nil, err
+	}
+	token, err := getToken(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	opts := CreateAclOpts{AclName: aclName(service)}
+	for _, cidr := range cidrs {
+		opts.Entries = append(opts.Entries, AclEntry{Cidr: cidr})
+	}
+	acl, err := findAcl(ctx, config, aclUrlPre, token, service)
+	if err != nil {
+		return nil, err
+	}
+	if acl == nil {
+		klog.Infof("Creating access control list %s of service:%s/%s: %v", opts.AclName, service.Namespace, service.Name, cidrs)
+		return createAcl(ctx, getAPIClient(config), aclUrlPre, token, opts)
+	}
+	var current []string
+	for _, entry := range acl.Entries {
+		current = append(current, entry.Cidr)
+	}
+	sort.Strings(current)
+	if strings.Join(current, ",") == strings.Join(cidrs, ",") {
+		return acl, nil
+	}
+	klog.Infof("Updating access control list %s of service:%s/%s: %v", opts.AclName, service.Namespace, service.Name, cidrs)
+	if _, err := modifyAcl(ctx, getAPIClient(config), aclUrlPre, token, acl.AclId, opts); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// hasAclListener returns true if a listener of ls owned by service has an access control list bound
+func hasAclListener(clusterName string, service *v1.Service, ls []Listener) bool {
+	for i := range ls {
+		if ls[i].AclStatus == aclStatusOn && ls[i].IsOwnedBy(clusterName, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteAcl deletes the access control list of service, if any. It must not be bound to listeners anymore.
+func DeleteAcl(ctx context.Context, config *InCloud, service *v1.Service) error {
+	aclUrlPre, err := config.aclUrlPre()
+	if err != nil {
+		return err
+	}
+	token, err := getToken(ctx, config)
+	if err != nil {
+		return err
+	}
+	acl, err := findAcl(ctx, config, aclUrlPre, token, service)
+	if err != nil || acl == nil {
+		return err
+	}
+	klog.Infof("Deleting access control list %s of service:%s/%s", acl.AclName, service.Namespace, service.Name)
+	return deleteAcl(ctx, getAPIClient(config), aclUrlPre, token, acl.AclId)
+}
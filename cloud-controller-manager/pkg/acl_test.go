@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/agiledragon/gomonkey"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetSourceRanges(t *testing.T) {
+	service := &v1.Service{Spec: v1.ServiceSpec{LoadBalancerSourceRanges: []string{"192.168.1.7/24", " 10.0.0.0/8"}}}
+	cidrs, err := getSourceRanges(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cidrs) != 2 || cidrs[0] != "10.0.0.0/8" || cidrs[1] != "192.168.1.0/24" {
+		t.Fatalf("unexpected cidrs %v", cidrs)
+	}
+	service.Spec.LoadBalancerSourceRanges = []string{"10.0.0.1"}
+	if _, err := getSourceRanges(service); !IsPermanentError(err) {
+		t.Fatalf("expected an invalid service error, got %v", err)
+	}
+}
+
+func TestEnsureAclWithoutAclUrlPre(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}}
+	c := &InCloud{}
+	if _, err := EnsureAcl(context.TODO(), c, service, []string{"10.0.0.0/8"}); !IsPermanentError(err) {
+		t.Fatalf("expected an invalid service error, got %v", err)
+	}
+}
+
+func TestEnsureAcl(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}}
+	c := &InCloud{config: Config{AclUrlPre: "https://acl"}}
+	var acls []Acl
+	var created, modified []CreateAclOpts
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(describeAclsByName, func(ctx context.Context, client *apiClient, url, token, aclName string) ([]Acl, error) {
+		return acls, nil
+	})
+	patch3 := ApplyFunc(createAcl, func(ctx context.Context, client *apiClient, url, token string, opts CreateAclOpts) (*Acl, error) {
+		created = append(created, opts)
+		acls = append(acls, Acl{AclId: "acl-1", AclName: opts.AclName, Entries: opts.Entries})
+		return &acls[0], nil
+	})
+	patch4 := ApplyFunc(modifyAcl, func(ctx context.Context, client *apiClient, url, token, aclId string, opts CreateAclOpts) (*Acl, error) {
+		modified = append(modified, opts)
+		acls[0].Entries = opts.Entries
+		return &acls[0], nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+
+	for _, cidrs := range [][]string{{"10.0.0.0/8"}, {"10.0.0.0/8"}, {"10.0.0.0/8", "192.168.0.0/16"}} {
+		acl, err := EnsureAcl(context.TODO(), c, service, cidrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acl.AclId != "acl-1" {
+			t.Fatalf("unexpected acl %v", acl)
+		}
+	}
+	if len(created) != 1 || created[0].AclName != "k8s-uid-1" {
+		t.Fatalf("unexpected creations %v", created)
+	}
+	if len(modified) != 1 || len(modified[0].Entries) != 2 {
+		t.Fatalf("unexpected modifications %v", modified)
+	}
+}
+
+func TestEnsureListenersDeletesAclOnlyOnceBound(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}}},
+	}
+	c := &InCloud{config: Config{AclUrlPre: "https://acl"}}
+	aclStatus := aclStatusOff
+	var described int
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_web_tcp_80", Protocol: "TCP", Port: 80, AclStatus: aclStatus},
+			// bound by another Service
+			{ListenerId: "l-2", ListenerName: "listener_kubernetes_default_api_tcp_443", Protocol: "TCP", Port: 443, AclStatus: aclStatusOn},
+		}, nil
+	})
+	patch2 := ApplyFunc(UpdateListener, func(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+		return &Listener{}, nil
+	})
+	patch3 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch4 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		return nil
+	})
+	patch5 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch6 := ApplyFunc(describeAclsByName, func(ctx context.Context, client *apiClient, url, token, aclName string) ([]Acl, error) {
+		described++
+		return nil, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+	defer patch6.Reset()
+
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if described != 0 {
+		t.Fatal("access control list looked up although no listener of the service had one")
+	}
+
+	aclStatus = aclStatusOn
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if described != 1 {
+		t.Fatal("access control list unbound from the listeners of the service not deleted")
+	}
+}
@@ -2,10 +2,8 @@ package pkg
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io/ioutil"
 	"k8s.io/klog"
 	"net/http"
@@ -29,55 +27,117 @@ type keycloakToken struct {
 	SessionState     string `json:"session_state"`
 }
 
-func getKeyCloakToken(requestedSubject, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (string, error) {
-	//return ic.KeycloakToken, nil
-	var grantType = "urn:ietf:params:oauth:grant-type:token-exchange"
-	var requestTokenType = "urn:ietf:params:oauth:token-type:refresh_token"
-	var audience = "console"
-	strReq := "grant_type=" + grantType + "&client_id=" + tokenClientId + "&client_secret=" + clientSecret +
-		"&request_token_type=" + requestTokenType + "&requested_subject=" + requestedSubject + "&audience=" + audience
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-	res, err1 := client.Post(keycloakUrl, "application/x-www-form-urlencoded", strings.NewReader(strReq))
-	if res != nil && res.StatusCode == 200 {
-		defer res.Body.Close()
-		body, err2 := ioutil.ReadAll(res.Body)
-		if err2 == nil {
-			var token keycloakToken
-			if err3 := json.Unmarshal(body, &token); err3 == nil {
-				return "Bearer " + token.AccessToken, nil
-			} else {
-				klog.Errorf("error to Unmarshal(body, &token): %v", err3)
-				return "", err3
+// getKeyCloakToken exchanges the token of requestedSubject for a token of audience
+func getKeyCloakToken(ctx context.Context, requestedSubject, tokenClientId, clientSecret, keycloakUrl, audience string, ic *InCloud) (*keycloakToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("client_id", tokenClientId)
+	form.Set("client_secret", clientSecret)
+	form.Set("request_token_type", "urn:ietf:params:oauth:token-type:refresh_token")
+	form.Set("requested_subject", requestedSubject)
+	form.Set("audience", audience)
+	return postKeycloakForm(ctx, getAPIClient(ic), keycloakUrl, form.Encode())
+}
+
+// getClientCredentialsToken obtains a token for the service account of tokenClientId
+func getClientCredentialsToken(ctx context.Context, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (*keycloakToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", tokenClientId)
+	form.Set("client_secret", clientSecret)
+	return postKeycloakForm(ctx, getAPIClient(ic), keycloakUrl, form.Encode())
+}
+
+// refreshKeyCloakToken uses the refresh token of a previous exchange to obtain a new access token
+func refreshKeyCloakToken(ctx context.Context, refreshToken, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (*keycloakToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", tokenClientId)
+	form.Set("client_secret", clientSecret)
+	form.Set("refresh_token", refreshToken)
+	return postKeycloakForm(ctx, getAPIClient(ic), keycloakUrl, form.Encode())
+}
+
+func postKeycloakForm(ctx context.Context, client *apiClient, keycloakUrl, strReq string) (*keycloakToken, error) {
+	req, err := http.NewRequest("POST", keycloakUrl, strings.NewReader(strReq))
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := doRequest(ctx, client, "postKeycloakForm", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var token keycloakToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		klog.Errorf("error to Unmarshal(body, &token): %v", err)
+		return nil, err
+	}
+	return &token, nil
+}
+
+// doRequest sends req, a request of operation on slbId, and returns the response body if the response status is expectedStatus,
+// otherwise the failure is returned as an *APIError. Failures are retried with exponential
+// backoff as long as they are retryable and sending req again is safe, see shouldRetry.
+func doRequest(ctx context.Context, client *apiClient, operation, slbId string, req *http.Request, expectedStatus int) ([]byte, error) {
+	req = req.WithContext(ctx)
+	backoff := client.backoff
+	for attempt := 1; ; attempt++ {
+		if client.limiter != nil {
+			if err := client.limiter.Wait(ctx, operation, slbId); err != nil {
+				return nil, err
 			}
-		} else {
-			klog.Errorf("error to read all res1.Body %v", err2)
-			return "", err2
 		}
-	} else {
-		if err1 != nil {
-			klog.Errorf("post request keycloak err: %v", err1)
-			return "", err1
+		if client.auth != nil && operation != "postKeycloakForm" {
+			// signatures cover the Date header, they are computed again on every attempt
+			if err := client.auth.Sign(req); err != nil {
+				return nil, err
+			}
+		}
+		body, err := sendRequest(client.httpClient, operation, req, expectedStatus)
+		if err == nil || attempt >= client.maxAttempts || !shouldRetry(operation, req, err) {
+			return body, err
 		}
-		if res != nil {
-			klog.Errorf("nil res or not ok status code, code: %d", res.StatusCode)
-			defer res.Body.Close()
+		delay := backoff.Step()
+		klog.Warningf("%s attempt %d failed, retrying in %v: %v", operation, attempt, delay, err)
+		if err := sleepWithContext(ctx, delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
 		}
-		return "", errors.New("nil res or not ok status code")
 	}
 }
 
-//http://cn-north-3.10.110.25.123.xip.io/slb/v1/slbs?slbId=123
-//按slb id查询用户的slb
-func describeLoadBalancer(url, token, slbId string) (*LoadBalancer, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func sendRequest(client *http.Client, operation string, req *http.Request, expectedStatus int) ([]byte, error) {
+	logRequest(operation, req)
+	res, err := client.Do(req)
+	if err != nil {
+		klog.Errorf("%s response error %v", operation, err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		klog.Errorf("%s get response body fail %v", operation, err)
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
+	logResponse(operation, res.StatusCode, body)
+	if res.StatusCode != expectedStatus {
+		apiErr := newAPIError(operation, res, body)
+		klog.Errorf("response not ok:%v", apiErr)
+		return nil, apiErr
+	}
+	return body, nil
+}
+
+// http://cn-north-3.10.110.25.123.xip.io/slb/v1/slbs?slbId=123
+// 按slb id查询用户的slb
+func describeLoadBalancer(ctx context.Context, client *apiClient, url, token, slbId string) (*LoadBalancer, error) {
 	reqUrl := url + "?slbId=" + slbId
-	klog.Infof("describeLoadBalancer requestUrl is %v,token is %v", reqUrl, token)
 	req, err := http.NewRequest("GET", reqUrl, nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -86,23 +146,11 @@ func describeLoadBalancer(url, token, slbId string) (*LoadBalancer, error) {
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
-	if err != nil {
-		klog.Errorf("Response error %v", err)
-		return nil, err
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := doRequest(ctx, client, "describeLoadBalancer", slbId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	var result []LoadBalancer
-	klog.Infof("result is:%v,%v ", res.StatusCode, string(body))
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		klog.Errorf("Unmarshal body fail: %v", err)
@@ -111,15 +159,11 @@ func describeLoadBalancer(url, token, slbId string) (*LoadBalancer, error) {
 	if nil != result && len(result) > 0 {
 		return &result[0], nil
 	} else {
-		return nil, errors.New("lb is empty")
+		return nil, ErrorNotFoundInCloud
 	}
 }
 
-func modifyLoadBalancer(url, token, slbId, slbName string) (*SlbResponse, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+func modifyLoadBalancer(ctx context.Context, client *apiClient, url, token, slbId, slbName string) (*SlbResponse, error) {
 	reqUrl := url + "/" + slbId
 	requestMap := make(map[string]string)
 	requestMap["slbName"] = slbName
@@ -128,7 +172,6 @@ func modifyLoadBalancer(url, token, slbId, slbName string) (*SlbResponse, error)
 		klog.Errorf("servers conver to bytes error %v", err)
 		return nil, err
 	}
-	klog.Infof("modifyLoadBalancer requestUrl is %v,requestBody is%v, token is %v", reqUrl, string(slbNameByte), token)
 	req, err := http.NewRequest("PUT", reqUrl, bytes.NewReader(slbNameByte))
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -137,21 +180,10 @@ func modifyLoadBalancer(url, token, slbId, slbName string) (*SlbResponse, error)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
-	if err != nil {
-		klog.Errorf("Response error %v", err)
-		return nil, err
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := doRequest(ctx, client, "modifyLoadBalancer", slbId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	var result SlbResponse
 	err = json.Unmarshal(body, &result)
 	if err != nil {
@@ -161,13 +193,8 @@ func modifyLoadBalancer(url, token, slbId, slbName string) (*SlbResponse, error)
 	return &result, nil
 }
 
-func deleteLoadBalancer(url, token, slbId string) error {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+func deleteLoadBalancer(ctx context.Context, client *apiClient, url, token, slbId string) error {
 	reqUrl := url + "/" + slbId
-	klog.Infof("deleteLoadBalancer requestUrl is %v,token is%v", reqUrl, token)
 	req, err := http.NewRequest("DELETE", reqUrl, nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -176,79 +203,92 @@ func deleteLoadBalancer(url, token, slbId string) error {
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
-	if err != nil {
-		klog.Errorf("Response error %v", err)
-		return err
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := doRequest(ctx, client, "deleteLoadBalancer", slbId, req, http.StatusAccepted)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
 		return err
 	}
-	if res.StatusCode != http.StatusAccepted {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	var result BackendList
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		klog.Errorf("Unmarshal body fail: %v", err)
 		return err
 	}
-	if result.code != strconv.Itoa(http.StatusAccepted) {
-		return errors.New("deleteLb fail," + result.Message)
+	if result.Code != strconv.Itoa(http.StatusAccepted) {
+		return &APIError{Operation: "deleteLoadBalancer", StatusCode: http.StatusAccepted, Code: result.Code, Message: result.Message}
 	}
 	return nil
 }
 
-func describeListenersBySlbId(url, token, slbId string) ([]Listener, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// releaseEip releases the EIP eipId, url is the prefix of the EIP API
+func releaseEip(ctx context.Context, client *apiClient, url, token, eipId string) error {
+	reqUrl := url + "/" + eipId
+	req, err := http.NewRequest("DELETE", reqUrl, nil)
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return err
 	}
-	client := &http.Client{Transport: tr}
-	reqUrl := url + "/" + slbId + "/listeners"
-	klog.Infof("describeListenersBySlbId requestUrl is %v,token is %v", reqUrl, token)
-	req, err := http.NewRequest("GET", reqUrl, nil)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	_, err = doRequest(ctx, client, "releaseEip", "", req, http.StatusOK)
+	return err
+}
+
+// describeLoadBalancersByName lists the SLBs of the user named slbName
+func describeLoadBalancersByName(ctx context.Context, client *apiClient, url, token, slbName string) ([]LoadBalancer, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
 		return nil, err
 	}
+	query := req.URL.Query()
+	query.Set("slbName", slbName)
+	req.URL.RawQuery = query.Encode()
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	body, err := doRequest(ctx, client, "describeLoadBalancersByName", "", req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	var result []LoadBalancer
+	err = json.Unmarshal(body, &result)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
+		klog.Errorf("Unmarshal body fail: %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
+	return result, nil
+}
+
+func createLoadBalancer(ctx context.Context, client *apiClient, url, token string, opts CreateLoadBalancerOpts) (*LoadBalancer, error) {
+	optsByte, err := json.Marshal(&opts)
+	if nil != err {
+		klog.Errorf("opts conver to bytes error %v", err)
+		return nil, err
 	}
-	var result []Listener
+	req, err := http.NewRequest("POST", url, bytes.NewReader(optsByte))
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "createLoadBalancer", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result LoadBalancer
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		klog.Errorf("Unmarshal body fail: %v", err)
 		return nil, err
 	}
-	return result, nil
+	return &result, nil
 }
 
-func describeListenerByListnerId(url, token, slbId, listnerId string) (*Listener, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-	reqUrl := url + "/" + slbId + "/listeners/" + listnerId
-	klog.Infof("describeListenerByListnerId requestUrl is %v,token is %v", reqUrl, token)
+func describeListenersBySlbId(ctx context.Context, client *apiClient, url, token, slbId string) ([]Listener, error) {
+	reqUrl := url + "/" + slbId + "/listeners"
 	req, err := http.NewRequest("GET", reqUrl, nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -257,20 +297,32 @@ func describeListenerByListnerId(url, token, slbId, listnerId string) (*Listener
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	body, err := doRequest(ctx, client, "describeListenersBySlbId", slbId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	var result []Listener
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		klog.Errorf("Unmarshal body fail: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+func describeListenerByListnerId(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) (*Listener, error) {
+	reqUrl := url + "/" + slbId + "/listeners/" + listnerId
+	req, err := http.NewRequest("GET", reqUrl, nil)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
+		klog.Errorf("Request error %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "describeListenerByListnerId", slbId, req, http.StatusOK)
+	if err != nil {
+		return nil, err
 	}
 	var result Listener
 	err = json.Unmarshal(body, &result)
@@ -281,19 +333,13 @@ func describeListenerByListnerId(url, token, slbId, listnerId string) (*Listener
 	return &result, nil
 }
 
-func createListener(url, token string, opts CreateListenerOpts) (*Listener, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+func createListener(ctx context.Context, client *apiClient, url, token string, opts CreateListenerOpts) (*Listener, error) {
 	reqUrl := url + "/" + opts.SLBId + "/listeners/"
-	klog.Infof("createListener requestUrl:%v,token:%v", reqUrl, token)
 	serversByte, err := json.Marshal(&opts)
 	if nil != err {
 		klog.Errorf("opts conver to bytes error %v", err)
 		return nil, err
 	}
-	klog.Infof("requestBody is : %v", string(serversByte))
 	req, err := http.NewRequest("POST", reqUrl, bytes.NewReader(serversByte))
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -302,21 +348,10 @@ func createListener(url, token string, opts CreateListenerOpts) (*Listener, erro
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	body, err := doRequest(ctx, client, "createListener", opts.SLBId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
-		return nil, err
-	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	var result Listener
 	err = json.Unmarshal(body, &result)
 	if err != nil {
@@ -326,20 +361,14 @@ func createListener(url, token string, opts CreateListenerOpts) (*Listener, erro
 	return &result, nil
 }
 
-func modifyListener(url, token, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+func modifyListener(ctx context.Context, client *apiClient, url, token, listenerid string, opts CreateListenerOpts) (*Listener, error) {
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
 	reqUrl := url + "/" + opts.SLBId + "/listeners/" + listenerid
-	klog.Infof("modifyListener requestUrl:%v,token%v", reqUrl, token)
 	serversByte, err := json.Marshal(&opts)
 	if nil != err {
 		klog.Errorf("opts conver to bytes error %v", err)
 		return nil, err
 	}
-	klog.Infof("requestBody is : %v", string(serversByte))
 	req, err := http.NewRequest("PUT", reqUrl, bytes.NewReader(serversByte))
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -348,21 +377,10 @@ func modifyListener(url, token, listenerid string, opts CreateListenerOpts) (*Li
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
-	if err != nil {
-		klog.Errorf("Response error %v", err)
-		return nil, err
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := doRequest(ctx, client, "modifyListener", opts.SLBId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	var result Listener
 	err = json.Unmarshal(body, &result)
 	if err != nil {
@@ -372,13 +390,8 @@ func modifyListener(url, token, listenerid string, opts CreateListenerOpts) (*Li
 	return &result, nil
 }
 
-func deleteListener(url, token, slbId, listnerId string) error {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
+func deleteListener(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) error {
 	reqUrl := url + "/" + slbId + "/listeners/" + listnerId
-	klog.Infof("deleteListener requestUrl:%v,token:%v", reqUrl, token)
 	req, err := http.NewRequest("DELETE", reqUrl, nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -387,38 +400,43 @@ func deleteListener(url, token, slbId, listnerId string) error {
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	_, err = doRequest(ctx, client, "deleteListener", slbId, req, http.StatusNoContent)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return nil
+}
+
+// describeCertificates lists the certificates of the user, url is the prefix of the certificate API
+func describeCertificates(ctx context.Context, client *apiClient, url, token string) ([]Certificate, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
-		return err
+		klog.Errorf("Request error %v", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "describeCertificates", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
 	}
-	if res.StatusCode != http.StatusNoContent {
-		klog.Errorf("response not ok:%v, %v", res.StatusCode, string(body))
-		return fmt.Errorf("response not ok %d", res.StatusCode)
+	var result []Certificate
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		klog.Errorf("Unmarshal body fail: %v", err)
+		return nil, err
 	}
-	return nil
+	return result, nil
 }
 
-func createBackend(url, token string, opts CreateBackendOpts) (*BackendList, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-	reqUrl := url + "/" + opts.SLBId + "/listeners/" + opts.ListenerId + "/members"
-	klog.Infof("createBackend requestUrl:%v,token:%v", reqUrl, token)
-	serversByte, err := json.Marshal(&opts.Servers)
-	klog.Infof("requestBody is : %v", string(serversByte))
+func uploadCertificate(ctx context.Context, client *apiClient, url, token string, opts UploadCertificateOpts) (*Certificate, error) {
+	optsByte, err := json.Marshal(&opts)
 	if nil != err {
-		klog.Errorf("servers conver to bytes error %v", err)
+		klog.Errorf("opts conver to bytes error %v", err)
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", reqUrl, bytes.NewReader(serversByte))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(optsByte))
 	if err != nil {
 		klog.Errorf("Request error %v", err)
 		return nil, err
@@ -426,22 +444,78 @@ func createBackend(url, token string, opts CreateBackendOpts) (*BackendList, err
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	body, err := doRequest(ctx, client, "uploadCertificate", "", req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	var result Certificate
+	err = json.Unmarshal(body, &result)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
+		klog.Errorf("Unmarshal body fail: %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
+	return &result, nil
+}
+
+func deleteCertificate(ctx context.Context, client *apiClient, url, token, certificateId string) error {
+	reqUrl := url + "/" + certificateId
+	req, err := http.NewRequest("DELETE", reqUrl, nil)
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return err
 	}
-	var result BackendList
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	_, err = doRequest(ctx, client, "deleteCertificate", "", req, http.StatusNoContent)
+	return err
+}
+
+// describeAclsByName lists the access control lists of the user named aclName, url is the prefix of the ACL API
+func describeAclsByName(ctx context.Context, client *apiClient, url, token, aclName string) ([]Acl, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return nil, err
+	}
+	query := req.URL.Query()
+	query.Set("aclName", aclName)
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "describeAclsByName", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result []Acl
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		klog.Errorf("Unmarshal body fail: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+func createAcl(ctx context.Context, client *apiClient, url, token string, opts CreateAclOpts) (*Acl, error) {
+	optsByte, err := json.Marshal(&opts)
+	if nil != err {
+		klog.Errorf("opts conver to bytes error %v", err)
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(optsByte))
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "createAcl", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result Acl
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		klog.Errorf("Unmarshal body fail: %v", err)
@@ -450,35 +524,90 @@ func createBackend(url, token string, opts CreateBackendOpts) (*BackendList, err
 	return &result, nil
 }
 
-func describeBackendservers(url, token, slbId, listnerId string) ([]Backend, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// modifyAcl replaces the entries of the access control list aclId
+func modifyAcl(ctx context.Context, client *apiClient, url, token, aclId string, opts CreateAclOpts) (*Acl, error) {
+	reqUrl := url + "/" + aclId
+	optsByte, err := json.Marshal(&opts)
+	if nil != err {
+		klog.Errorf("opts conver to bytes error %v", err)
+		return nil, err
 	}
-	client := &http.Client{Transport: tr}
-	reqUrl := url + "/" + slbId + "/listeners/" + listnerId + "/members"
-	klog.Infof("describeBackendservers requestUrl:%v, token:%v", reqUrl, token)
-	req, err := http.NewRequest("GET", reqUrl, nil)
+	req, err := http.NewRequest("PUT", reqUrl, bytes.NewReader(optsByte))
 	if err != nil {
 		klog.Errorf("Request error %v", err)
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "modifyAcl", "", req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result Acl
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		klog.Errorf("Unmarshal body fail: %v", err)
+		return nil, err
+	}
+	return &result, nil
+}
+
+func deleteAcl(ctx context.Context, client *apiClient, url, token, aclId string) error {
+	reqUrl := url + "/" + aclId
+	req, err := http.NewRequest("DELETE", reqUrl, nil)
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return err
+	}
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	_, err = doRequest(ctx, client, "deleteAcl", "", req, http.StatusNoContent)
+	return err
+}
+
+func createBackend(ctx context.Context, client *apiClient, url, token string, opts CreateBackendOpts) (*BackendList, error) {
+	reqUrl := url + "/" + opts.SLBId + "/listeners/" + opts.ListenerId + "/members"
+	serversByte, err := json.Marshal(&opts.Servers)
+	if nil != err {
+		klog.Errorf("servers conver to bytes error %v", err)
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", reqUrl, bytes.NewReader(serversByte))
 	if err != nil {
-		klog.Errorf("Response error %v", err)
+		klog.Errorf("Request error %v", err)
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "createBackend", opts.SLBId, req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result BackendList
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		klog.Errorf("Unmarshal body fail: %v", err)
+		return nil, err
+	}
+	return &result, nil
+}
+
+func describeBackendservers(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) ([]Backend, error) {
+	reqUrl := url + "/" + slbId + "/listeners/" + listnerId + "/members"
+	req, err := http.NewRequest("GET", reqUrl, nil)
 	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
+		klog.Errorf("Request error %v", err)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-		return nil, fmt.Errorf("response not ok %d", res.StatusCode)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	body, err := doRequest(ctx, client, "describeBackendservers", slbId, req, http.StatusOK)
+	if err != nil {
+		return nil, err
 	}
 	var result []Backend
 	err = json.Unmarshal(body, &result)
@@ -490,15 +619,30 @@ func describeBackendservers(url, token, slbId, listnerId string) ([]Backend, err
 
 }
 
-func removeBackendServers(slburl, token, slbId, listnerId string, backendIdList []string) error {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// modifyBackendServer changes the weight of the member backendId
+func modifyBackendServer(ctx context.Context, client *apiClient, url, token, slbId, listnerId, backendId string, opts ModifyBackendOpts) error {
+	reqUrl := url + "/" + slbId + "/listeners/" + listnerId + "/members/" + backendId
+	optsByte, err := json.Marshal(&opts)
+	if nil != err {
+		klog.Errorf("opts conver to bytes error %v", err)
+		return err
 	}
-	client := &http.Client{Transport: tr}
+	req, err := http.NewRequest("PUT", reqUrl, bytes.NewReader(optsByte))
+	if err != nil {
+		klog.Errorf("Request error %v", err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	_, err = doRequest(ctx, client, "modifyBackendServer", slbId, req, http.StatusOK)
+	return err
+}
+
+func removeBackendServers(ctx context.Context, client *apiClient, slburl, token, slbId, listnerId string, backendIdList []string) error {
 	bks := strings.Join(backendIdList, "\",\"")
 	reqUrl, _ := url.Parse(slburl + "/" + slbId + "/listeners/" + listnerId + "/members" + "?backendIdList=[\"" + bks + "\"]")
 	reqUrl.RawQuery = reqUrl.Query().Encode()
-	klog.Infof("removeBackendServers requestUrl:%v, token:%v", reqUrl, token)
 	req, err := http.NewRequest("DELETE", reqUrl.String(), nil)
 	if err != nil {
 		klog.Errorf("Request error %v", err)
@@ -507,20 +651,9 @@ func removeBackendServers(slburl, token, slbId, listnerId string, backendIdList
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	res, err := client.Do(req)
+	_, err = doRequest(ctx, client, "removeBackendServers", slbId, req, http.StatusOK)
 	if err != nil {
-		klog.Errorf("Response error %v", err)
 		return err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		klog.Errorf("Get response body fail %v", err)
-		return err
-	}
-	if res.StatusCode != http.StatusOK {
-		klog.Errorf("response not ok:%v, %v", res.StatusCode, string(body))
-		return fmt.Errorf("response not ok %d", res.StatusCode)
-	}
 	return nil
 }
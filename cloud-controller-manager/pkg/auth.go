@@ -0,0 +1,167 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// values of the auth-type cloud-config key
+const (
+	// AuthTypeTokenExchange exchanges the token of requested-subject for a token of audience
+	AuthTypeTokenExchange = "token-exchange"
+	// AuthTypeClientCredentials authenticates as the service account of token-client-id
+	AuthTypeClientCredentials = "client-credentials"
+	// AuthTypeStaticToken sends kktoken as is, it must be rotated through the secret
+	AuthTypeStaticToken = "static-token"
+	// AuthTypeAKSK signs every request with access-key-id and secret-access-key
+	AuthTypeAKSK = "aksk"
+
+	defaultAuthType = AuthTypeTokenExchange
+	defaultAudience = "console"
+
+	akskAlgorithm = "HMAC-SHA256"
+)
+
+var ErrorNoStaticToken = errors.New("auth-type static-token needs kktoken")
+
+// authProvider authenticates the requests sent to the SLB API
+type authProvider interface {
+	// Token returns the value of the Authorization header of SLB requests,
+	// empty for providers which sign every request instead
+	Token(ctx context.Context) (string, error)
+	// Sign is called before every attempt of a SLB request, once its headers are set
+	Sign(req *http.Request) error
+	// Invalidate drops cached tokens, after the API rejected them or the credentials were rotated
+	Invalidate()
+}
+
+// newAuthProvider returns the provider selected by the auth-type of config
+func newAuthProvider(ic *InCloud, config Config) (authProvider, error) {
+	switch config.AuthType {
+	case AuthTypeTokenExchange:
+		return newKeycloakTokenSource(ic, tokenExchangeGrant(config.Audience)), nil
+	case AuthTypeClientCredentials:
+		return newKeycloakTokenSource(ic, clientCredentialsGrant), nil
+	case AuthTypeStaticToken:
+		return &staticTokenProvider{ic: ic}, nil
+	case AuthTypeAKSK:
+		return &akskSigner{ic: ic, accessKeyID: config.AccessKeyID, now: time.Now}, nil
+	}
+	return nil, fmt.Errorf("unknown auth-type %q", config.AuthType)
+}
+
+// staticTokenProvider sends the keycloak token of the credentials with every request
+type staticTokenProvider struct {
+	ic *InCloud
+}
+
+func (p *staticTokenProvider) Token(ctx context.Context) (string, error) {
+	token := p.ic.credentials().KeycloakToken
+	if token == "" {
+		return "", ErrorNoStaticToken
+	}
+	if !strings.HasPrefix(token, "Bearer ") {
+		token = "Bearer " + token
+	}
+	return token, nil
+}
+
+func (p *staticTokenProvider) Sign(req *http.Request) error {
+	return nil
+}
+
+// Invalidate does nothing, a rejected token is only replaced by rotating the secret
+func (p *staticTokenProvider) Invalidate() {}
+
+// akskSigner signs every request with an HMAC-SHA256 of its canonical form, keyed
+// with the secret access key:
+//
+//	METHOD\nPATH\nSORTED QUERY\ncontent-type:...\ndate:...\nhost:...\nHEX(SHA256(BODY))
+//
+// The signature is sent as
+//
+//	Authorization: HMAC-SHA256 Credential=<access-key-id>, SignedHeaders=content-type;date;host, Signature=<hex>
+type akskSigner struct {
+	ic          *InCloud
+	accessKeyID string
+	now         func() time.Time
+}
+
+// Token returns nothing, the Authorization header is set by Sign
+func (s *akskSigner) Token(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+func (s *akskSigner) Sign(req *http.Request) error {
+	secretAccessKey := s.ic.credentials().SecretAccessKey
+	if s.accessKeyID == "" || secretAccessKey == "" {
+		return fmt.Errorf("auth-type %s needs access-key-id and secret-access-key", AuthTypeAKSK)
+	}
+	req.Header.Set("Date", s.now().UTC().Format(time.RFC1123))
+
+	body := []byte{}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if body, err = ioutil.ReadAll(rc); err != nil {
+			return err
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secretAccessKey))
+	mac.Write(canonicalRequest(req, body))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=content-type;date;host, Signature=%s",
+		akskAlgorithm, s.accessKeyID, hex.EncodeToString(mac.Sum(nil))))
+	return nil
+}
+
+// Invalidate does nothing, signatures are not cached
+func (s *akskSigner) Invalidate() {}
+
+func canonicalRequest(req *http.Request, body []byte) []byte {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, k+"="+v)
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+
+	var b bytes.Buffer
+	b.WriteString(req.Method + "\n")
+	b.WriteString(path + "\n")
+	b.WriteString(strings.Join(params, "&") + "\n")
+	b.WriteString("content-type:" + strings.TrimSpace(req.Header.Get("Content-Type")) + "\n")
+	b.WriteString("date:" + req.Header.Get("Date") + "\n")
+	b.WriteString("host:" + req.URL.Host + "\n")
+	b.WriteString(hex.EncodeToString(bodyHash[:]))
+	return b.Bytes()
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAuthProvider(t *testing.T) {
+	ic := &InCloud{KeycloakToken: "t0k3n"}
+	for _, authType := range []string{AuthTypeTokenExchange, AuthTypeClientCredentials, AuthTypeStaticToken, AuthTypeAKSK} {
+		if _, err := newAuthProvider(ic, Config{AuthType: authType}); err != nil {
+			t.Errorf("%s: %v", authType, err)
+		}
+	}
+	if _, err := newAuthProvider(ic, Config{AuthType: "kerberos"}); err == nil {
+		t.Error("expected an error for an unknown auth-type")
+	}
+
+	p, _ := newAuthProvider(ic, Config{AuthType: AuthTypeStaticToken})
+	if token, err := p.Token(context.TODO()); err != nil || token != "Bearer t0k3n" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+}
+
+func TestTokenExchangeAudience(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("audience") != "slb" || r.Form.Get("requested_subject") != "user" {
+			t.Errorf("unexpected form %v", r.Form)
+		}
+		w.Write([]byte(`{"access_token":"a","expires_in":300}`))
+	}))
+	defer server.Close()
+
+	ic := &InCloud{KeycloakUrl: server.URL, RequestedSubject: "user", TokenClientID: "cke", ClientSecret: "s"}
+	ic.auth, _ = newAuthProvider(ic, Config{AuthType: AuthTypeTokenExchange, Audience: "slb"})
+	if token, err := getToken(context.TODO(), ic); err != nil || token != "Bearer a" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+}
+
+func TestAKSKSignerSignsEveryAttempt(t *testing.T) {
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures = append(signatures, r.Header.Get("Authorization"))
+		if len(signatures) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	now := time.Unix(1000, 0)
+	ic := &InCloud{SecretAccessKey: "sk"}
+	signer := &akskSigner{ic: ic, accessKeyID: "ak", now: func() time.Time { now = now.Add(time.Second); return now }}
+	client := newTestAPIClient(2)
+	client.auth = signer
+
+	req, _ := http.NewRequest("PUT", server.URL+"/slbs/slb-1?b=2&a=1", strings.NewReader(`{"slbName":"n"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := doRequest(context.TODO(), client, "modifyLoadBalancer", "slb-1", req, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 2 || signatures[0] == signatures[1] {
+		t.Fatalf("expected a new signature per attempt, got %v", signatures)
+	}
+	if !strings.HasPrefix(signatures[0], "HMAC-SHA256 Credential=ak, SignedHeaders=content-type;date;host, Signature=") {
+		t.Fatalf("unexpected authorization %s", signatures[0])
+	}
+
+	// the signature only depends on the request and the date
+	again, _ := http.NewRequest("PUT", server.URL+"/slbs/slb-1?a=1&b=2", strings.NewReader(`{"slbName":"n"}`))
+	again.Header.Set("Content-Type", "application/json")
+	now = time.Unix(1000, 0)
+	signer.Sign(again)
+	if again.Header.Get("Authorization") != signatures[0] {
+		t.Fatalf("signature is not canonical: %s != %s", again.Header.Get("Authorization"), signatures[0])
+	}
+}
+
+func TestReadConfigAuthTypes(t *testing.T) {
+	valid := map[string]string{
+		"default":            testCloudConfig,
+		"client-credentials": "[Global]\nauth-type = client-credentials\nkeycloakUrl = k\ntoken-client-id = c\nclient-secret = s\nslbUrl-pre = s\n",
+		"static-token":       "[Global]\nauth-type = static-token\nkktoken = t\nslbUrl-pre = s\n",
+		"aksk":               "[Global]\nauth-type = aksk\naccess-key-id = ak\nsecret-access-key = sk\nslbUrl-pre = s\n",
+		"aksk from secret":   "[Global]\nauth-type = aksk\naccess-key-id = ak\nsecret-name = incloud\nslbUrl-pre = s\n",
+	}
+	for name, c := range valid {
+		config, err := readConfig(strings.NewReader(c))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Audience != defaultAudience {
+			t.Errorf("%s: default audience not applied", name)
+		}
+	}
+
+	invalid := map[string]string{
+		"unknown auth-type":      "[Global]\nauth-type = kerberos\nslbUrl-pre = s\n",
+		"static without kktoken": "[Global]\nauth-type = static-token\nslbUrl-pre = s\n",
+		"aksk without ak":        "[Global]\nauth-type = aksk\nsecret-access-key = sk\nslbUrl-pre = s\n",
+	}
+	for name, c := range invalid {
+		if _, err := readConfig(strings.NewReader(c)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
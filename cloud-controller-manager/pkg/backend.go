@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
 	"k8s.io/api/core/v1"
@@ -11,6 +12,13 @@ import (
 
 var ErrorBackendNotFound = fmt.Errorf("Cannot find backend")
 
+// weights of the members, see getBackendWeights
+const (
+	defaultBackendWeight = 10
+	minBackendWeight     = 1
+	maxBackendWeight     = 100
+)
+
 type Backend struct {
 	BackendId   string `json:"backendId"`
 	ListenerId  string `json:"listenerId"`
@@ -37,8 +45,12 @@ type BackendServer struct {
 	Weight      int    `json:"weight"`
 }
 
+type ModifyBackendOpts struct {
+	Weight int `json:"weight"`
+}
+
 type BackendList struct {
-	code    string           `json:"code"`
+	Code    string           `json:"code"`
 	Message string           `json:"message"`
 	Data    []*BackendServer `json:"data"`
 }
@@ -64,21 +76,25 @@ type SlbResponse struct {
 	State             string    `json:"state"`
 }
 
-func CreateBackends(config *InCloud, opts CreateBackendOpts) (*BackendList, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+func CreateBackends(ctx context.Context, config *InCloud, opts CreateBackendOpts) (*BackendList, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
-	return createBackend(config.LbUrlPre, token, opts)
+	return createBackend(ctx, getAPIClient(config), config.slbUrlPre(), token, opts)
 }
 
-func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) error {
+// UpdateBackends registers the nodes in backends as members of listener on backendPort, the NodePort
+// of the listener's Service port. Members on another port, after the NodePort changed, are replaced.
+// Members get the weight of their node in weights, defaultBackendWeight if it has none, and members
+// whose weight changed are updated in place.
+func UpdateBackends(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
 	//先查询listenner关联的backends
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return error
 	}
-	backs, error := describeBackendservers(config.LbUrlPre, token, listener.SLBId, listener.ListenerId)
+	backs, error := describeBackendservers(ctx, getAPIClient(config), config.slbUrlPre(), token, listener.SLBId, listener.ListenerId)
 	if error != nil {
 		klog.Errorf("describeBackendservers failed : %v", error)
 		return error
@@ -91,15 +107,26 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 	add, del := []*BackendServer{}, []string{}
 	// checkout for newly added servers
 	for _, node := range nodes {
-		found := false
+		weight, ok := weights[node.Name]
+		if !ok {
+			weight = defaultBackendWeight
+		}
+		var found *Backend
 		anno := getNodeAnnotation(node, common.NodeAnnotationInstanceID, "")
-		for _, back := range backs {
-			if back.ServerId == anno {
-				found = true
+		for i := range backs {
+			if backs[i].ServerId == anno && backs[i].Port == backendPort {
+				found = &backs[i]
 				break
 			}
 		}
-		if !found {
+		if found != nil && found.Weight != weight {
+			klog.V(logLevelRequests).Infof("update weight of backend server %s(%s):%d from %d to %d", node.Name, found.ServerIp, found.Port, found.Weight, weight)
+			if err := ModifyBackendWeight(ctx, config, listener.SLBId, listener.ListenerId, found.BackendId, weight); err != nil {
+				klog.Infof("ModifyBackendWeight failed: %v", err)
+				return err
+			}
+		}
+		if found == nil {
 			addr, err := nodeAddressForLB(node)
 			if err != nil {
 				if err == ErrorBackendNotFound {
@@ -113,12 +140,12 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 			server := new(BackendServer)
 			server.ServerId = GetNodeInstanceID(node)
 			server.ServerIp = addr
-			server.Port = listener.Port
+			server.Port = backendPort
 			server.ServerName = node.Name
 			server.ServierType = "ECS"
-			server.Weight = 10
+			server.Weight = weight
 			add = append(add, server)
-			klog.Infof("add backend server:%v", &add)
+			klog.V(logLevelRequests).Infof("add backend server %s(%s):%d", server.ServerName, server.ServerIp, server.Port)
 		}
 	}
 	if len(add) > 0 {
@@ -127,7 +154,7 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 			ListenerId: listener.ListenerId,
 			Servers:    add,
 		}
-		_, err := CreateBackends(config, opts)
+		_, err := CreateBackends(ctx, config, opts)
 		if nil != err {
 			klog.Infof("CreateBackends failed: %v", err)
 			return err
@@ -137,7 +164,7 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 	for _, back := range backs {
 		found := false
 		for _, node := range nodes {
-			if back.ServerId == getNodeAnnotation(node, common.NodeAnnotationInstanceID, "") {
+			if back.ServerId == getNodeAnnotation(node, common.NodeAnnotationInstanceID, "") && back.Port == backendPort {
 				found = true
 				break
 			}
@@ -147,7 +174,7 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 		}
 	}
 	if len(del) > 0 {
-		err := DeleteBackends(config, listener.SLBId, listener.ListenerId, del)
+		err := DeleteBackends(ctx, config, listener.SLBId, listener.ListenerId, del)
 		if nil != err {
 			klog.Infof("DeleteBackends failed: %v", err)
 			return err
@@ -156,22 +183,30 @@ func UpdateBackends(config *InCloud, listener *Listener, backends interface{}) e
 	return nil
 }
 
-func DeleteBackends(config *InCloud, slbid, listenerId string, backendIdList []string) error {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+func ModifyBackendWeight(ctx context.Context, config *InCloud, slbid, listenerId, backendId string, weight int) error {
+	token, error := getToken(ctx, config)
+	if error != nil {
+		return error
+	}
+	return modifyBackendServer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, listenerId, backendId, ModifyBackendOpts{Weight: weight})
+}
+
+func DeleteBackends(ctx context.Context, config *InCloud, slbid, listenerId string, backendIdList []string) error {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return error
 	}
-	error = removeBackendServers(config.LbUrlPre, token, slbid, listenerId, backendIdList)
+	error = removeBackendServers(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, listenerId, backendIdList)
 
 	return error
 }
 
-func GetBackends(config *InCloud, slbid, listenerId string) ([]Backend, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+func GetBackends(ctx context.Context, config *InCloud, slbid, listenerId string) ([]Backend, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
-	backends, error := describeBackendservers(config.LbUrlPre, token, slbid, listenerId)
+	backends, error := describeBackendservers(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, listenerId)
 	if nil != error {
 		klog.Infof("GetBackends failed: %v", error)
 		return nil, error
@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/agiledragon/gomonkey"
+	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateBackendsReplacesMembersOnOldNodePort(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{common.NodeAnnotationInstanceID: "i-1"}},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	var added []*BackendServer
+	var deleted []string
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(describeBackendservers, func(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) ([]Backend, error) {
+		return []Backend{{BackendId: "b-1", ServerId: "i-1", Port: 30080}}, nil
+	})
+	patch3 := ApplyFunc(CreateBackends, func(ctx context.Context, config *InCloud, opts CreateBackendOpts) (*BackendList, error) {
+		added = append(added, opts.Servers...)
+		return &BackendList{}, nil
+	})
+	patch4 := ApplyFunc(DeleteBackends, func(ctx context.Context, config *InCloud, slbid, listenerId string, backendIdList []string) error {
+		deleted = append(deleted, backendIdList...)
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+
+	listener := &Listener{SLBId: "slb-1", ListenerId: "l-1", Port: 80}
+	if err := UpdateBackends(context.TODO(), &InCloud{}, listener, 30081, []*v1.Node{node}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].ServerId != "i-1" || added[0].Port != 30081 {
+		t.Fatalf("unexpected members added %v", added)
+	}
+	if len(deleted) != 1 || deleted[0] != "b-1" {
+		t.Fatalf("unexpected members deleted %v", deleted)
+	}
+}
+
+func TestUpdateBackendsUpdatesWeights(t *testing.T) {
+	node := func(name, instance string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{common.NodeAnnotationInstanceID: instance}},
+			Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}},
+		}
+	}
+	var added []*BackendServer
+	modified := make(map[string]int)
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(describeBackendservers, func(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) ([]Backend, error) {
+		return []Backend{
+			{BackendId: "b-1", ServerId: "i-1", Port: 30080, Weight: 10},
+			{BackendId: "b-2", ServerId: "i-2", Port: 30080, Weight: 10},
+		}, nil
+	})
+	patch3 := ApplyFunc(CreateBackends, func(ctx context.Context, config *InCloud, opts CreateBackendOpts) (*BackendList, error) {
+		added = append(added, opts.Servers...)
+		return &BackendList{}, nil
+	})
+	patch4 := ApplyFunc(ModifyBackendWeight, func(ctx context.Context, config *InCloud, slbid, listenerId, backendId string, weight int) error {
+		modified[backendId] = weight
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+
+	nodes := []*v1.Node{node("node-1", "i-1"), node("node-2", "i-2"), node("node-3", "i-3")}
+	weights := map[string]int{"node-1": 30, "node-3": 50}
+	listener := &Listener{SLBId: "slb-1", ListenerId: "l-1", Port: 80}
+	if err := UpdateBackends(context.TODO(), &InCloud{}, listener, 30080, nodes, weights); err != nil {
+		t.Fatal(err)
+	}
+	if len(modified) != 1 || modified["b-1"] != 30 {
+		t.Fatalf("unexpected weights modified %v", modified)
+	}
+	if len(added) != 1 || added[0].ServerId != "i-3" || added[0].Weight != 50 {
+		t.Fatalf("unexpected members added %v", added)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// certificateVersionLength is the length of the certificate hash ending the names of uploaded certificates
+const certificateVersionLength = 16
+
+// Certificate is a certificate of the certificate management of inspur cloud
+type Certificate struct {
+	CertificateId   string `json:"certificateId"`
+	CertificateName string `json:"certificateName"`
+}
+
+type UploadCertificateOpts struct {
+	CertificateName string `json:"certificateName"`
+	Certificate     string `json:"certificate"`
+	PrivateKey      string `json:"privateKey"`
+}
+
+// certificateVersion returns the hash of the certificate and key held by secret
+func certificateVersion(secret *v1.Secret) string {
+	h := sha256.New()
+	h.Write(secret.Data[v1.TLSCertKey])
+	h.Write(secret.Data[v1.TLSPrivateKeyKey])
+	return hex.EncodeToString(h.Sum(nil))[:certificateVersionLength]
+}
+
+// certificatePrefix returns the prefix of the names of the certificates uploaded for service.
+// Every Service gets its own certificates, so that they are rotated and deleted with its listeners.
+func certificatePrefix(service *v1.Service) string {
+	return fmt.Sprintf("k8s-%s-", service.UID)
+}
+
+// certificateFromSecret returns the certificate held by secret, which must be a valid kubernetes.io/tls Secret
+func certificateFromSecret(service *v1.Service, secret *v1.Secret) (UploadCertificateOpts, error) {
+	if secret.Type != v1.SecretTypeTLS {
+		return UploadCertificateOpts{}, &InvalidServiceError{Reason: fmt.Sprintf("secret %s/%s is of type %s, not %s",
+			secret.Namespace, secret.Name, secret.Type, v1.SecretTypeTLS)}
+	}
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return UploadCertificateOpts{}, &InvalidServiceError{Reason: fmt.Sprintf("secret %s/%s does not hold a valid certificate: %v",
+			secret.Namespace, secret.Name, err)}
+	}
+	return UploadCertificateOpts{
+		CertificateName: certificatePrefix(service) + certificateVersion(secret),
+		Certificate:     string(cert),
+		PrivateKey:      string(key),
+	}, nil
+}
+
+// certUrlPre returns the prefix of the certificate API urls
+func (ic *InCloud) certUrlPre() (string, error) {
+	certUrlPre := ic.currentConfig().CertUrlPre
+	if certUrlPre == "" {
+		return "", fmt.Errorf("cloud config key certUrl-pre is not set, certificates cannot be uploaded")
+	}
+	return certUrlPre, nil
+}
+
+// EnsureCertificate uploads the certificate of secret for service, unless it is already uploaded
+func EnsureCertificate(ctx context.Context, config *InCloud, service *v1.Service, secret *v1.Secret) (*Certificate, error) {
+	opts, err := certificateFromSecret(service, secret)
+	if err != nil {
+		return nil, err
+	}
+	certUrlPre, err := config.certUrlPre()
+	if err != nil {
+		return nil, err
+	}
+	token, err := getToken(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := describeCertificates(ctx, getAPIClient(config), certUrlPre, token)
+	if err != nil {
+		return nil, err
+	}
+	for i := range certs {
+		if certs[i].CertificateName == opts.CertificateName {
+			return &certs[i], nil
+		}
+	}
+	klog.Infof("Uploading certificate %s from secret %s/%s", opts.CertificateName, secret.Namespace, secret.Name)
+	return uploadCertificate(ctx, getAPIClient(config), certUrlPre, token, opts)
+}
+
+// DeleteCertificates deletes the certificates uploaded for service, except keep. A certificate still
+// bound to a listener is refused by the API, it is deleted by a later sync.
+func DeleteCertificates(ctx context.Context, config *InCloud, service *v1.Service, keep string) error {
+	certUrlPre, err := config.certUrlPre()
+	if err != nil {
+		return err
+	}
+	token, err := getToken(ctx, config)
+	if err != nil {
+		return err
+	}
+	certs, err := describeCertificates(ctx, getAPIClient(config), certUrlPre, token)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, cert := range certs {
+		if cert.CertificateId == keep || !strings.HasPrefix(cert.CertificateName, certificatePrefix(service)) {
+			continue
+		}
+		klog.Infof("Deleting certificate %s of service:%s/%s", cert.CertificateName, service.Namespace, service.Name)
+		if err := deleteCertificate(ctx, getAPIClient(config), certUrlPre, token, cert.CertificateId); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", cert.CertificateName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete certificates %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// hasCertificateListener returns true if a listener of ls owned by service has a certificate bound
+func hasCertificateListener(clusterName string, service *v1.Service, ls []Listener) bool {
+	for i := range ls {
+		if ls[i].CertificateId != "" && ls[i].IsOwnedBy(clusterName, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureServiceCertificate uploads the certificate of the Secret referenced by service
+func (ic *InCloud) ensureServiceCertificate(ctx context.Context, service *v1.Service) (*Certificate, error) {
+	name := getServiceAnnotation(service, common.ServiceAnnotationLBCertSecret, "")
+	if name == "" {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("HTTPS listeners need the annotation %s", common.ServiceAnnotationLBCertSecret)}
+	}
+	if ic.kubeClient == nil {
+		return nil, fmt.Errorf("kubernetes client is not initialized")
+	}
+	secret, err := ic.kubeClient.CoreV1().Secrets(service.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the Service is synced again once the Secret is created, see watchCertificateSecrets
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("secret %s/%s not found", service.Namespace, name)}
+		}
+		return nil, err
+	}
+	return EnsureCertificate(ctx, ic, service, secret)
+}
+
+// watchCertificateSecrets watches the kubernetes.io/tls Secrets named by the cert-secret annotation of the
+// LoadBalancer Services. When one of them changes, the Services referencing it get the new version in their
+// cert-secret-version annotation, which makes the service controller sync them, that is upload the new
+// certificate and bind it to their HTTPS listeners.
+// It is only started with certUrl-pre set.
+func (ic *InCloud) watchCertificateSecrets(clientset kubernetes.Interface, stop <-chan struct{}) {
+	w := newCertificateSecretWatches(func(namespace, name string, done <-chan struct{}) {
+		ic.watchCertificateSecret(clientset, namespace, name, done)
+	}, stop)
+	ic.serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.update(obj.(*v1.Service))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			w.update(obj.(*v1.Service))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if service, ok := obj.(*v1.Service); ok {
+				w.set(serviceKey(service), "")
+			}
+		},
+	})
+}
+
+// watchCertificateSecret watches the Secret namespace/name until done is closed. Only this Secret is
+// listed and cached, not every Secret of the namespace.
+func (ic *InCloud) watchCertificateSecret(clientset kubernetes.Interface, namespace, name string, done <-chan struct{}) {
+	klog.V(logLevelRequests).Infof("Watching certificate secret %s/%s", namespace, name)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	secretInformer := factory.Core().V1().Secrets().Informer()
+	sync := func(obj interface{}) {
+		if secret := obj.(*v1.Secret); secret.Type == v1.SecretTypeTLS {
+			ic.syncCertificateSecret(secret)
+		}
+	}
+	secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: sync,
+		UpdateFunc: func(_, obj interface{}) {
+			sync(obj)
+		},
+	})
+	go secretInformer.Run(done)
+}
+
+// certificateSecretWatches keeps a watch on each Secret named by the cert-secret annotation of
+// at least one LoadBalancer Service
+type certificateSecretWatches struct {
+	watch func(namespace, name string, done <-chan struct{})
+	stop  <-chan struct{}
+
+	mu sync.Mutex
+	// secret of each Service, by namespace/name
+	secrets map[string]string
+	// Services referencing each Secret and the channel stopping its watch
+	refs  map[string]int
+	dones map[string]chan struct{}
+}
+
+func newCertificateSecretWatches(watch func(namespace, name string, done <-chan struct{}), stop <-chan struct{}) *certificateSecretWatches {
+	return &certificateSecretWatches{
+		watch:   watch,
+		stop:    stop,
+		secrets: make(map[string]string),
+		refs:    make(map[string]int),
+		dones:   make(map[string]chan struct{}),
+	}
+}
+
+// update watches the certificate Secret of service, if any, instead of the one it used before
+func (w *certificateSecretWatches) update(service *v1.Service) {
+	secret := ""
+	if name := getServiceAnnotation(service, common.ServiceAnnotationLBCertSecret, ""); name != "" &&
+		service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		secret = service.Namespace + "/" + name
+	}
+	w.set(serviceKey(service), secret)
+}
+
+// set records secret as the certificate Secret of the Service key, empty if it has none. The
+// watch of a Secret is started with its first Service and stopped with its last one.
+func (w *certificateSecretWatches) set(key, secret string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.secrets[key]
+	if old == secret {
+		return
+	}
+	if old != "" {
+		delete(w.secrets, key)
+		if w.refs[old]--; w.refs[old] == 0 {
+			close(w.dones[old])
+			delete(w.refs, old)
+			delete(w.dones, old)
+		}
+	}
+	if secret == "" {
+		return
+	}
+	w.secrets[key] = secret
+	if w.refs[secret]++; w.refs[secret] > 1 {
+		return
+	}
+	done := make(chan struct{})
+	w.dones[secret] = done
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-w.stop:
+		}
+		close(stop)
+	}()
+	// built by update, a valid key
+	namespace, name, _ := cache.SplitMetaNamespaceKey(secret)
+	w.watch(namespace, name, stop)
+}
+
+func (ic *InCloud) syncCertificateSecret(secret *v1.Secret) {
+	services, err := ic.serviceInformer.Lister().Services(secret.Namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list the services using secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		return
+	}
+	version := certificateVersion(secret)
+	for _, service := range services {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer ||
+			getServiceAnnotation(service, common.ServiceAnnotationLBCertSecret, "") != secret.Name ||
+			getServiceAnnotation(service, common.ServiceAnnotationLBCertVersion, "") == version {
+			continue
+		}
+		klog.Infof("Certificate secret %s/%s of service:%s/%s changed", secret.Namespace, secret.Name, service.Namespace, service.Name)
+		if err := ic.setServiceAnnotation(service, common.ServiceAnnotationLBCertVersion, version); err != nil {
+			klog.Errorf("Failed to record the certificate version of service:%s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestTLSSecret(t *testing.T, commonName string) *v1.Secret {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-tls"},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			v1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		},
+	}
+}
+
+func TestCertificateFromSecret(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}}
+	secret := newTestTLSSecret(t, "web")
+	opts, err := certificateFromSecret(service, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.CertificateName != "k8s-uid-1-"+certificateVersion(secret) || !strings.Contains(opts.PrivateKey, "PRIVATE KEY") {
+		t.Fatalf("unexpected certificate %s", opts.CertificateName)
+	}
+
+	// a new certificate gets a new name
+	if rotated := newTestTLSSecret(t, "web"); certificateVersion(rotated) == certificateVersion(secret) {
+		t.Fatal("rotated certificate has the same version")
+	}
+
+	opaque := secret.DeepCopy()
+	opaque.Type = v1.SecretTypeOpaque
+	broken := secret.DeepCopy()
+	broken.Data[v1.TLSPrivateKeyKey] = []byte("garbage")
+	for _, s := range []*v1.Secret{opaque, broken} {
+		if _, err := certificateFromSecret(service, s); !IsPermanentError(err) {
+			t.Errorf("expected an invalid service error, got %v", err)
+		}
+	}
+}
+
+func TestEnsureCertificateUploadsOnce(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}}
+	secret := newTestTLSSecret(t, "web")
+	c := &InCloud{config: Config{CertUrlPre: "https://cert"}}
+	var uploaded []string
+	certs := []Certificate{{CertificateId: "c-old", CertificateName: "k8s-uid-1-0123456789abcdef"}}
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(describeCertificates, func(ctx context.Context, client *apiClient, url, token string) ([]Certificate, error) {
+		return certs, nil
+	})
+	patch3 := ApplyFunc(uploadCertificate, func(ctx context.Context, client *apiClient, url, token string, opts UploadCertificateOpts) (*Certificate, error) {
+		uploaded = append(uploaded, opts.CertificateName)
+		certs = append(certs, Certificate{CertificateId: "c-new", CertificateName: opts.CertificateName})
+		return &certs[len(certs)-1], nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+
+	for i := 0; i < 2; i++ {
+		cert, err := EnsureCertificate(context.TODO(), c, service, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.CertificateId != "c-new" {
+			t.Fatalf("unexpected certificate %v", cert)
+		}
+	}
+	if len(uploaded) != 1 {
+		t.Fatalf("expected a single upload, got %v", uploaded)
+	}
+}
+
+func TestEnsureListenersDeletesCertificatesOnlyForHTTPS(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}}},
+	}
+	c := &InCloud{config: Config{CertUrlPre: "https://cert"}}
+	certificateId := ""
+	var described int
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_web_tcp_80", Protocol: "TCP", Port: 80, CertificateId: certificateId},
+			// HTTPS listener of another Service
+			{ListenerId: "l-2", ListenerName: "listener_kubernetes_default_api_tcp_443", Protocol: "HTTPS", Port: 443, CertificateId: "cert-2"},
+		}, nil
+	})
+	patch2 := ApplyFunc(UpdateListener, func(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+		return &Listener{}, nil
+	})
+	patch3 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch4 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		return nil
+	})
+	patch5 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch6 := ApplyFunc(describeCertificates, func(ctx context.Context, client *apiClient, url, token string) ([]Certificate, error) {
+		described++
+		return nil, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+	defer patch6.Reset()
+
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if described != 0 {
+		t.Fatal("certificates looked up for a service which never had HTTPS listeners")
+	}
+
+	// the port was served by an HTTPS listener before this sync
+	certificateId = "cert-1"
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if described != 1 {
+		t.Fatal("certificates of the former HTTPS listener not deleted")
+	}
+}
+
+func TestCertificateSecretWatches(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	watched := make(map[string]<-chan struct{})
+	w := newCertificateSecretWatches(func(namespace, name string, done <-chan struct{}) {
+		watched[namespace+"/"+name] = done
+	}, stop)
+	service := func(name, secret string, serviceType v1.ServiceType) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: map[string]string{
+				"loadbalancer.inspur.com/cert-secret": secret,
+			}},
+			Spec: v1.ServiceSpec{Type: serviceType},
+		}
+	}
+	stopped := func(secret string) bool {
+		select {
+		case <-watched[secret]:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	w.update(service("web", "tls-1", v1.ServiceTypeLoadBalancer))
+	w.update(service("api", "tls-1", v1.ServiceTypeLoadBalancer))
+	w.update(service("internal", "tls-2", v1.ServiceTypeClusterIP))
+	if len(watched) != 1 || watched["default/tls-1"] == nil {
+		t.Fatalf("expected only the secret of the LoadBalancer services to be watched, got %v", watched)
+	}
+
+	// the Secret is watched until its last Service stops using it
+	w.update(service("web", "tls-2", v1.ServiceTypeLoadBalancer))
+	if len(watched) != 2 || stopped("default/tls-1") {
+		t.Fatalf("unexpected watches %v", watched)
+	}
+	w.set("default/api", "")
+	if !stopped("default/tls-1") || stopped("default/tls-2") {
+		t.Fatal("expected only the watch of tls-1 to be stopped")
+	}
+}
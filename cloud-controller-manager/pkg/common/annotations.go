@@ -24,9 +24,52 @@ const (
 	ServiceAnnotationLBdomainHealthCheck = "loadbalancer.inspur.com/healthcheck-domain"
 	//Listener pathHealthCheck
 	ServiceAnnotationLBpathHealthCheck = "loadbalancer.inspur.com/healthcheck-path"
+	//Listener requestHealthCheck, the payload sent by the health checks of UDP listeners
+	ServiceAnnotationLBrequestHealthCheck = "loadbalancer.inspur.com/healthcheck-udp-request"
+	//Listener responseHealthCheck, the payload expected from healthy members of UDP listeners
+	ServiceAnnotationLBresponseHealthCheck = "loadbalancer.inspur.com/healthcheck-udp-response"
+
+	//SLB created when the slbid annotation is missing, defaults are taken from the cloud-config
+	//SLB subnetId
+	ServiceAnnotationLBSubnetId = "loadbalancer.inspur.com/subnet-id"
+	//SLB scheme, internet-facing or internal
+	ServiceAnnotationLBScheme = "loadbalancer.inspur.com/scheme"
+	//SLB specificationId
+	ServiceAnnotationLBSpecification = "loadbalancer.inspur.com/specification"
+	//SLB slbName
+	ServiceAnnotationLBName = "loadbalancer.inspur.com/name"
+	//set by the controller to the slbid of the SLB it created, a missing one is created again
+	ServiceAnnotationLBProvisionedSlbId = "loadbalancer.inspur.com/provisioned-slbid"
+	//set by the controller to the EIP of the SLB it created while the SLB is deleted, the EIP is released once unbound
+	ServiceAnnotationLBEipId = "loadbalancer.inspur.com/eip-id"
+
+	//Listener protocols, e.g. "https:443,http:80", ports not listed use the protocol of the Service port
+	ServiceAnnotationLBProtocolPort = "loadbalancer.inspur.com/protocol-port"
+	//kubernetes.io/tls Secret, in the namespace of the Service, holding the certificate of the HTTPS listeners
+	ServiceAnnotationLBCertSecret = "loadbalancer.inspur.com/cert-secret"
+	//set by the controller to the version of the certificate Secret, a change triggers a sync of the Service
+	ServiceAnnotationLBCertVersion = "loadbalancer.inspur.com/cert-secret-version"
+
+	//cookie persistence of the HTTP and HTTPS listeners, insert or rewrite
+	ServiceAnnotationLBCookiePersistence = "loadbalancer.inspur.com/cookie-persistence"
+	//name of the cookie rewritten by the rewrite persistence
+	ServiceAnnotationLBCookieName = "loadbalancer.inspur.com/cookie-name"
+	//lifetime in seconds of the cookie inserted by the insert persistence
+	ServiceAnnotationLBCookieTimeout = "loadbalancer.inspur.com/cookie-timeout"
+
+	//type of the access control list built from loadBalancerSourceRanges, white (default) or black
+	ServiceAnnotationLBAclType = "loadbalancer.inspur.com/acl-type"
+	//Listener members, label selector of the nodes registered as members, e.g. a node pool
+	ServiceAnnotationLBBackendLabel = "loadbalancer.inspur.com/backend-label"
+	//Listener members, weight of the members, 1 to 100
+	ServiceAnnotationLBBackendWeight = "loadbalancer.inspur.com/backend-weight"
+	//Listener members, "true" multiplies the weight of the members by their ready endpoints
+	ServiceAnnotationLBWeightByEndpoints = "loadbalancer.inspur.com/backend-weight-by-endpoints"
 
 	/*Instances
 	 */
 
 	NodeAnnotationInstanceID = "node.beta.kubernetes.io/instance-id"
+	//weight of the node as member of the listeners, overrides the backend-weight annotation of the Services
+	NodeLabelBackendWeight = "loadbalancer.inspur.com/backend-weight"
 )
@@ -0,0 +1,224 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/gcfg.v1"
+)
+
+// cloudConfigFile is the layout of the cloud-config file, all settings live in the [Global] section:
+//
+//	[Global]
+//	keycloakUrl = https://keycloak.example.com/auth/realms/picp/protocol/openid-connect/token
+//	client-secret = "secret;with#special=chars"
+//	slbUrl-pre = https://service.cloud.inspur.com/regionsvc-cn-north/slb/v1/slbs
+//
+// Files written for older releases, which have no section header, are read as if
+// they were in [Global].
+type cloudConfigFile struct {
+	Global Config
+}
+
+// readConfig parses the cloud-config given to the provider with --cloud-config,
+// rejects unknown keys, applies defaults and validates the result
+func readConfig(config io.Reader) (Config, error) {
+	if config == nil {
+		err := fmt.Errorf("no incloud provider config file given")
+		return Config{}, err
+	}
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return Config{}, fmt.Errorf("read cloud config: %v", err)
+	}
+	if !hasSectionHeader(data) {
+		data = append([]byte("[Global]\n"), data...)
+	}
+
+	var cfg cloudConfigFile
+	if err := gcfg.ReadStringInto(&cfg, string(data)); err != nil {
+		return Config{}, fmt.Errorf("parse cloud config: %v", err)
+	}
+	loadCredentialsFromEnv(&cfg.Global)
+	cfg.Global.applyDefaults()
+	if err := cfg.Global.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg.Global, nil
+}
+
+// LoadCloudCfg reads the cloud-config file at path
+func LoadCloudCfg(path string) (Config, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("load cloud config file: %v", err)
+	}
+	defer fi.Close()
+	return readConfig(fi)
+}
+
+// hasSectionHeader returns true if the first setting of data is preceded by a section header
+func hasSectionHeader(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		return line[0] == '['
+	}
+	return false
+}
+
+func (c *Config) applyDefaults() {
+	if c.SecretNamespace == "" {
+		c.SecretNamespace = "kube-system"
+	}
+	if c.SecretClientSecretKey == "" {
+		c.SecretClientSecretKey = defaultSecretClientSecretKey
+	}
+	if c.SecretTokenKey == "" {
+		c.SecretTokenKey = defaultSecretTokenKey
+	}
+	if c.SecretSecretAccessKeyKey == "" {
+		c.SecretSecretAccessKeyKey = defaultSecretSecretAccessKeyKey
+	}
+	if c.SlbScheme == "" {
+		c.SlbScheme = defaultSlbScheme
+	}
+	if c.AuthType == "" {
+		c.AuthType = defaultAuthType
+	}
+	if c.Audience == "" {
+		c.Audience = defaultAudience
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if c.RetryMaxAttempts == 0 {
+		c.RetryMaxAttempts = defaultRetryMaxAttempts
+	}
+	if c.RetryInitialDelay == 0 {
+		c.RetryInitialDelay = defaultRetryInitialDelay
+	}
+	if c.RetryMaxDelay == 0 {
+		c.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if c.RateLimitQPS == 0 {
+		c.RateLimitQPS = defaultRateLimitQPS
+	}
+	if c.RateLimitBurst == 0 {
+		c.RateLimitBurst = defaultRateLimitBurst
+	}
+	if c.SlbRateLimitQPS == 0 {
+		c.SlbRateLimitQPS = defaultSlbRateLimitQPS
+	}
+	if c.SlbRateLimitBurst == 0 {
+		c.SlbRateLimitBurst = defaultSlbRateLimitBurst
+	}
+}
+
+// String formats c without its credentials, so that it can be logged
+func (c Config) String() string {
+	redacted := c
+	if redacted.ClientSecret != "" {
+		redacted.ClientSecret = "<redacted>"
+	}
+	if redacted.KeycloakToken != "" {
+		redacted.KeycloakToken = "<redacted>"
+	}
+	if redacted.SecretAccessKey != "" {
+		redacted.SecretAccessKey = "<redacted>"
+	}
+	type config Config // drops the String method
+	return fmt.Sprintf("%+v", config(redacted))
+}
+
+func (c *Config) validate() error {
+	var missing []string
+	required := map[string]string{
+		"slbUrl-pre": c.SlbUrlPre,
+	}
+	// credentials in a secret are only read once the provider is initialized
+	fromSecret := c.SecretName != ""
+	switch c.AuthType {
+	case AuthTypeTokenExchange:
+		required["keycloakUrl"] = c.KeycloakUrl
+		required["requested-subject"] = c.RequestedSubject
+		required["token-client-id"] = c.TokenClientID
+		if !fromSecret {
+			required["client-secret"] = c.ClientSecret
+		}
+	case AuthTypeClientCredentials:
+		required["keycloakUrl"] = c.KeycloakUrl
+		required["token-client-id"] = c.TokenClientID
+		if !fromSecret {
+			required["client-secret"] = c.ClientSecret
+		}
+	case AuthTypeStaticToken:
+		if !fromSecret {
+			required["kktoken"] = c.KeycloakToken
+		}
+	case AuthTypeAKSK:
+		required["access-key-id"] = c.AccessKeyID
+		if !fromSecret {
+			required["secret-access-key"] = c.SecretAccessKey
+		}
+	default:
+		return fmt.Errorf("cloud config key auth-type must be one of %s, %s, %s or %s, got %q", AuthTypeTokenExchange,
+			AuthTypeClientCredentials, AuthTypeStaticToken, AuthTypeAKSK, c.AuthType)
+	}
+	for key, value := range required {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("cloud config is missing required keys: %s", strings.Join(missing, ", "))
+	}
+
+	for key, value := range map[string]int{
+		"request-timeout":         c.RequestTimeout,
+		"idle-conn-timeout":       c.IdleConnTimeout,
+		"max-idle-conns-per-host": c.MaxIdleConnsPerHost,
+		"retry-max-attempts":      c.RetryMaxAttempts,
+		"retry-initial-delay":     c.RetryInitialDelay,
+		"retry-max-delay":         c.RetryMaxDelay,
+		"rate-limit-burst":        c.RateLimitBurst,
+		"slb-rate-limit-burst":    c.SlbRateLimitBurst,
+	} {
+		if value < 0 {
+			return fmt.Errorf("cloud config key %s must not be negative, got %d", key, value)
+		}
+	}
+	if c.RateLimitQPS < 0 || c.SlbRateLimitQPS < 0 {
+		return fmt.Errorf("cloud config keys rate-limit-qps and slb-rate-limit-qps must not be negative")
+	}
+	if c.RetryInitialDelay > c.RetryMaxDelay {
+		return fmt.Errorf("cloud config key retry-initial-delay (%d) is larger than retry-max-delay (%d)", c.RetryInitialDelay, c.RetryMaxDelay)
+	}
+	if c.SlbScheme != SchemeInternetFacing && c.SlbScheme != SchemeInternal {
+		return fmt.Errorf("cloud config key slb-scheme must be %s or %s, got %q", SchemeInternetFacing, SchemeInternal, c.SlbScheme)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cloud config keys cert-file and key-file must be set together")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+const testCloudConfig = `
+# incloud cloud-config
+[Global]
+keycloakUrl = https://keycloak.example.com/token
+client-secret = "s3cr3t;#"
+requested-subject = user
+token-client-id = cke
+slbUrl-pre = https://slb.example.com/slb/v1/slbs ; comment
+request-timeout = 10
+`
+
+func TestReadConfig(t *testing.T) {
+	config, err := readConfig(strings.NewReader(testCloudConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientSecret != "s3cr3t;#" || config.SlbUrlPre != "https://slb.example.com/slb/v1/slbs" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if config.RequestTimeout != 10 || config.RetryMaxAttempts != defaultRetryMaxAttempts || config.RateLimitQPS != defaultRateLimitQPS {
+		t.Fatalf("defaults not applied %+v", config)
+	}
+}
+
+func TestReadConfigWithoutSection(t *testing.T) {
+	legacy := "keycloakUrl=https://keycloak.example.com/token\nclient-secret=s\nrequested-subject=u\ntoken-client-id=c\nslbUrl-pre=https://slb.example.com\n"
+	config, err := readConfig(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.KeycloakUrl != "https://keycloak.example.com/token" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown key":     testCloudConfig + "slbid = slb-1\n",
+		"missing key":     "[Global]\nkeycloakUrl = https://keycloak.example.com/token\n",
+		"invalid value":   testCloudConfig + "retry-max-attempts = many\n",
+		"negative value":  testCloudConfig + "rate-limit-burst = -1\n",
+		"partial keypair": testCloudConfig + "cert-file = /etc/ssl/client.pem\n",
+	}
+	for name, c := range cases {
+		if _, err := readConfig(strings.NewReader(c)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := readConfig(nil); err == nil {
+		t.Error("expected an error without config")
+	}
+}
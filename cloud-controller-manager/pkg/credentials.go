@@ -0,0 +1,154 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	// EnvClientSecret and EnvKeycloakToken supply the credentials through the environment,
+	// typically from a secretKeyRef in the cloud-controller-manager pod spec
+	EnvClientSecret    = "INCLOUD_CLIENT_SECRET"
+	EnvKeycloakToken   = "INCLOUD_KEYCLOAK_TOKEN"
+	EnvSecretAccessKey = "INCLOUD_SECRET_ACCESS_KEY"
+
+	defaultSecretClientSecretKey    = "client-secret"
+	defaultSecretTokenKey           = "kktoken"
+	defaultSecretSecretAccessKeyKey = "secret-access-key"
+)
+
+// cloudCredentials are the secrets used by the auth providers, each provider only needs some of them
+type cloudCredentials struct {
+	ClientSecret    string
+	KeycloakToken   string
+	SecretAccessKey string
+}
+
+// loadCredentialsFromEnv overrides the credentials of config with the environment, if set
+func loadCredentialsFromEnv(config *Config) {
+	if v := os.Getenv(EnvClientSecret); v != "" {
+		config.ClientSecret = v
+	}
+	if v := os.Getenv(EnvKeycloakToken); v != "" {
+		config.KeycloakToken = v
+	}
+	if v := os.Getenv(EnvSecretAccessKey); v != "" {
+		config.SecretAccessKey = v
+	}
+}
+
+// credentialsFromSecret returns the credentials stored in secret
+func credentialsFromSecret(config Config, secret *v1.Secret) (cloudCredentials, error) {
+	creds := cloudCredentials{
+		ClientSecret:    string(secret.Data[config.SecretClientSecretKey]),
+		KeycloakToken:   string(secret.Data[config.SecretTokenKey]),
+		SecretAccessKey: string(secret.Data[config.SecretSecretAccessKeyKey]),
+	}
+	if creds == (cloudCredentials{}) {
+		return creds, fmt.Errorf("secret %s/%s has none of the keys %q, %q and %q", secret.Namespace, secret.Name,
+			config.SecretClientSecretKey, config.SecretTokenKey, config.SecretSecretAccessKeyKey)
+	}
+	return creds, nil
+}
+
+// validateCredentials checks that creds hold the credential needed by the auth-type of config
+func validateCredentials(config Config, creds cloudCredentials) error {
+	var key, value string
+	switch config.AuthType {
+	case AuthTypeTokenExchange, AuthTypeClientCredentials:
+		key, value = config.SecretClientSecretKey, creds.ClientSecret
+	case AuthTypeStaticToken:
+		key, value = config.SecretTokenKey, creds.KeycloakToken
+	case AuthTypeAKSK:
+		key, value = config.SecretSecretAccessKeyKey, creds.SecretAccessKey
+	}
+	if value == "" {
+		return fmt.Errorf("auth-type %s needs the key %q", config.AuthType, key)
+	}
+	return nil
+}
+
+// watchCredentialsSecret loads the credentials from the Secret referenced by config, then
+// keeps watching it so that rotated credentials are used without a restart
+func (ic *InCloud) watchCredentialsSecret(clientset kubernetes.Interface, config Config, stop <-chan struct{}) {
+	secret, err := clientset.CoreV1().Secrets(config.SecretNamespace).Get(config.SecretName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Failed to get credentials secret %s/%s: %v", config.SecretNamespace, config.SecretName, err)
+	} else {
+		ic.updateCredentialsFromSecret(config, secret)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(config.SecretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", config.SecretName).String()
+		}))
+	secretInformer := factory.Core().V1().Secrets().Informer()
+	secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ic.updateCredentialsFromSecret(config, obj.(*v1.Secret))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			ic.updateCredentialsFromSecret(config, obj.(*v1.Secret))
+		},
+		DeleteFunc: func(obj interface{}) {
+			klog.Warningf("Credentials secret %s/%s was deleted, keeping the last known credentials", config.SecretNamespace, config.SecretName)
+		},
+	})
+	go secretInformer.Run(stop)
+}
+
+func (ic *InCloud) updateCredentialsFromSecret(config Config, secret *v1.Secret) {
+	creds, err := credentialsFromSecret(config, secret)
+	if err == nil {
+		// the auth-type may have been changed by a reload of the cloud-config
+		err = validateCredentials(ic.currentConfig(), creds)
+	}
+	if err != nil {
+		klog.Errorf("Ignoring credentials secret: %v", err)
+		return
+	}
+	if ic.setCredentials(creds) {
+		klog.Infof("Loaded credentials from secret %s/%s (resourceVersion %s)", secret.Namespace, secret.Name, secret.ResourceVersion)
+	}
+}
+
+// setCredentials replaces the credentials used to authenticate, it returns false if they did not change
+func (ic *InCloud) setCredentials(creds cloudCredentials) bool {
+	ic.credMu.Lock()
+	changed := ic.ClientSecret != creds.ClientSecret || ic.KeycloakToken != creds.KeycloakToken ||
+		ic.SecretAccessKey != creds.SecretAccessKey
+	ic.ClientSecret = creds.ClientSecret
+	ic.KeycloakToken = creds.KeycloakToken
+	ic.SecretAccessKey = creds.SecretAccessKey
+	ic.credMu.Unlock()
+
+	if auth := ic.authProvider(); changed && auth != nil {
+		// tokens obtained with the previous credentials may be revoked with them
+		auth.Invalidate()
+	}
+	return changed
+}
+
+// credentials returns the credentials currently in use
+func (ic *InCloud) credentials() cloudCredentials {
+	ic.credMu.RLock()
+	defer ic.credMu.RUnlock()
+	return cloudCredentials{
+		ClientSecret:    ic.ClientSecret,
+		KeycloakToken:   ic.KeycloakToken,
+		SecretAccessKey: ic.SecretAccessKey,
+	}
+}
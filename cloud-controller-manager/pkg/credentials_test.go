@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReadConfigCredentialsFromEnv(t *testing.T) {
+	os.Setenv(EnvClientSecret, "from-env")
+	defer os.Unsetenv(EnvClientSecret)
+
+	config, err := readConfig(strings.NewReader("[Global]\nkeycloakUrl = k\nrequested-subject = u\ntoken-client-id = c\nslbUrl-pre = s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientSecret != "from-env" {
+		t.Fatalf("expected the client secret from the environment, got %q", config.ClientSecret)
+	}
+}
+
+func TestReadConfigCredentialsFromSecret(t *testing.T) {
+	config, err := readConfig(strings.NewReader("[Global]\nkeycloakUrl = k\nrequested-subject = u\ntoken-client-id = c\nslbUrl-pre = s\nsecret-name = incloud\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "incloud"},
+		Data:       map[string][]byte{"client-secret": []byte("rotated")},
+	}
+	creds, err := credentialsFromSecret(config, secret)
+	if err != nil || creds.ClientSecret != "rotated" {
+		t.Fatalf("got %q, %v", creds.ClientSecret, err)
+	}
+	if _, err := credentialsFromSecret(config, &v1.Secret{}); err == nil {
+		t.Fatal("expected an error for a secret without credentials")
+	}
+}
+
+func TestSetCredentialsInvalidatesToken(t *testing.T) {
+	ic := &InCloud{ClientSecret: "old"}
+	ts := newKeycloakTokenSource(ic, clientCredentialsGrant)
+	ts.token = &keycloakToken{AccessToken: "a"}
+	ic.auth = ts
+
+	if !ic.setCredentials(cloudCredentials{ClientSecret: "new"}) {
+		t.Fatal("expected the credentials to change")
+	}
+	if clientSecret := ic.credentials().ClientSecret; clientSecret != "new" || ts.token != nil {
+		t.Fatalf("credentials not rotated: %q", clientSecret)
+	}
+	if ic.setCredentials(cloudCredentials{ClientSecret: "new"}) {
+		t.Fatal("expected the credentials to be unchanged")
+	}
+}
+
+func TestConfigStringRedactsCredentials(t *testing.T) {
+	s := Config{ClientSecret: "s3cr3t", KeycloakToken: "t0k3n", SlbUrlPre: "https://slb"}.String()
+	if strings.Contains(s, "s3cr3t") || strings.Contains(s, "t0k3n") || !strings.Contains(s, "https://slb") {
+		t.Fatalf("unexpected config string %s", s)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1informer "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// endpointsSyncDelay debounces endpoints changes: the members of a Service are synced once
+	// per delay, however many of its pods are rescheduled meanwhile, e.g. by a rolling update
+	endpointsSyncDelay = 5 * time.Second
+	// endpointsSyncTimeout bounds the SLB requests of one sync
+	endpointsSyncTimeout = 2 * time.Minute
+	// endpointsMaxRetries is the number of retries of a failed sync, the next change retries again
+	endpointsMaxRetries = 5
+)
+
+// endpointsController refreshes the members of the listeners of a Service with externalTrafficPolicy
+// Local when its endpoints move to other nodes. The service controller only does it when the nodes of
+// the cluster change. The members of the other Services are every node, see getServiceNodes.
+type endpointsController struct {
+	ic    *InCloud
+	queue workqueue.RateLimitingInterface
+	delay time.Duration
+}
+
+func newEndpointsController(ic *InCloud, informer corev1informer.EndpointsInformer) *endpointsController {
+	c := &endpointsController{
+		ic:    ic,
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "incloud-endpoints"),
+		delay: endpointsSyncDelay,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			if endpointNodesChanged(old.(*v1.Endpoints), cur.(*v1.Endpoints)) {
+				c.enqueue(cur)
+			}
+		},
+		DeleteFunc: c.enqueue,
+	})
+	return c
+}
+
+// enqueue schedules the sync of the Service of the endpoints obj after the debounce delay,
+// the delaying queue keeps a single entry per Service
+func (c *endpointsController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("Couldn't get key for endpoints %+v: %v", obj, err)
+		return
+	}
+	c.queue.AddAfter(key, c.delay)
+}
+
+// Run syncs the queued Services until stop is closed
+func (c *endpointsController) Run(stop <-chan struct{}) {
+	defer c.queue.ShutDown()
+	go wait.Until(c.worker, time.Second, stop)
+	<-stop
+}
+
+func (c *endpointsController) worker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *endpointsController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.ic.syncServiceMembers(key.(string))
+	if err == nil || IsPermanentError(err) {
+		c.queue.Forget(key)
+		if err != nil {
+			klog.Errorf("Failed to sync the members of service:%s: %v", key, err)
+		}
+		return true
+	}
+	if c.queue.NumRequeues(key) < endpointsMaxRetries {
+		klog.Warningf("Failed to sync the members of service:%s, will retry: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	klog.Errorf("Failed to sync the members of service:%s, giving up until its endpoints change: %v", key, err)
+	c.queue.Forget(key)
+	return true
+}
+
+// endpointNodesChanged returns true if the ready addresses of cur are not on the same nodes as those of old,
+// or not as many per node, which changes the weights of the members, see getBackendWeights
+func endpointNodesChanged(old, cur *v1.Endpoints) bool {
+	return strings.Join(endpointNodeKeys(old), ",") != strings.Join(endpointNodeKeys(cur), ",")
+}
+
+// endpointNodeKeys returns the sorted node names, or addresses if they have no node, of the ready addresses
+// of endpoints, a node name is repeated for every address on the node
+func endpointNodeKeys(endpoints *v1.Endpoints) []string {
+	var keys []string
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil {
+				keys = append(keys, *addr.NodeName)
+			} else {
+				keys = append(keys, addr.IP)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syncServiceMembers registers the nodes hosting the endpoints of the Service key as members of
+// its listeners, with the cluster name and the nodes of the last sync of the service controller
+func (ic *InCloud) syncServiceMembers(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	service, err := ic.serviceInformer.Lister().Services(namespace).Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || !isLocalTrafficPolicy(service) ||
+		getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "") == "" {
+		return nil
+	}
+	clusterName, nodes, ok := ic.lastSync()
+	if !ok {
+		// the service controller syncs every Service once started
+		return nil
+	}
+
+	defer ic.serviceLocks.Lock(key)()
+	svcNodes, err := ic.getServiceNodes(service, nodes)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), endpointsSyncTimeout)
+	defer cancel()
+	return ic.updateMembers(ctx, clusterName, service, svcNodes)
+}
+
+// updateMembers registers nodes as the members of the listeners of service, the listeners
+// themselves are left to the service controller
+func (ic *InCloud) updateMembers(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	if len(nodes) == 0 {
+		klog.Warningf("Service:%s/%s has no nodes to register, keeping its members", service.Namespace, service.Name)
+		return nil
+	}
+	weights, err := ic.getBackendWeights(service, nodes)
+	if err != nil {
+		return err
+	}
+	ls, err := GetListeners(ctx, ic, service)
+	if err != nil {
+		return err
+	}
+	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
+	for _, port := range service.Spec.Ports {
+		listener := GetListenerForPort(ls, port)
+		if listener == nil || !listener.IsOwnedBy(clusterName, service) {
+			// created by the next sync of the service controller
+			continue
+		}
+		listener.SLBId = slbid
+		klog.V(logLevelRequests).Infof("Updating the members of listener %s of service:%s/%s", listener.ListenerName, service.Namespace, service.Name)
+		if err := UpdateBackends(ctx, ic, listener, int(port.NodePort), nodes, weights); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordSync remembers the cluster name and the nodes given by the service controller
+func (ic *InCloud) recordSync(clusterName string, nodes []*v1.Node) {
+	ic.syncMu.Lock()
+	defer ic.syncMu.Unlock()
+	ic.syncedClusterName = clusterName
+	ic.syncedNodes = nodes
+	ic.synced = true
+}
+
+// lastSync returns the cluster name and the nodes of the last sync of the service controller,
+// ok is false until it synced a Service
+func (ic *InCloud) lastSync() (clusterName string, nodes []*v1.Node, ok bool) {
+	ic.syncMu.RLock()
+	defer ic.syncMu.RUnlock()
+	return ic.syncedClusterName, ic.syncedNodes, ic.synced
+}
+
+// keyedMutex serializes the syncs of a Service by the service controller and the endpoints controller
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function unlocking it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*refMutex)
+	}
+	m := k.locks[key]
+	if m == nil {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		k.mu.Lock()
+		m.refs--
+		if m.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestEndpointNodesChanged(t *testing.T) {
+	node1, node2 := "node-1", "node-2"
+	endpoints := func(addresses ...v1.EndpointAddress) *v1.Endpoints {
+		return &v1.Endpoints{Subsets: []v1.EndpointSubset{{Addresses: addresses}}}
+	}
+	old := endpoints(v1.EndpointAddress{IP: "172.16.0.1", NodeName: &node1}, v1.EndpointAddress{IP: "172.16.0.2", NodeName: &node2})
+	// a pod replaced on the same node
+	same := endpoints(v1.EndpointAddress{IP: "172.16.0.3", NodeName: &node2}, v1.EndpointAddress{IP: "172.16.0.1", NodeName: &node1})
+	if endpointNodesChanged(old, same) {
+		t.Fatal("endpoints on the same nodes reported as changed")
+	}
+	// the weights of the members follow the endpoints per node
+	scaled := endpoints(v1.EndpointAddress{IP: "172.16.0.1", NodeName: &node1}, v1.EndpointAddress{IP: "172.16.0.2", NodeName: &node2},
+		v1.EndpointAddress{IP: "172.16.0.3", NodeName: &node2})
+	if !endpointNodesChanged(old, scaled) {
+		t.Fatal("endpoints added to a node not reported as changed")
+	}
+	moved := endpoints(v1.EndpointAddress{IP: "172.16.0.1", NodeName: &node1})
+	if !endpointNodesChanged(old, moved) {
+		t.Fatal("endpoints leaving a node not reported as changed")
+	}
+}
+
+func TestEndpointsControllerDebounces(t *testing.T) {
+	c := &endpointsController{
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test"),
+		delay: 50 * time.Millisecond,
+	}
+	defer c.queue.ShutDown()
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	for i := 0; i < 3; i++ {
+		c.enqueue(ep)
+	}
+	if c.queue.Len() != 0 {
+		t.Fatal("endpoints change synced before the delay")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if c.queue.Len() != 1 {
+		t.Fatalf("expected a single sync, got %d", c.queue.Len())
+	}
+}
+
+func TestUpdateMembersOnlyTouchesOwnedListeners(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{
+			"service.beta.kubernetes.io/inspur-load-balancer-slbid": "slb-1",
+		}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+			{Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP},
+		}},
+	}
+	var updated []string
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_web_tcp_80", Protocol: "TCP", Port: 80},
+			{ListenerId: "l-2", ListenerName: "listener_kubernetes_default_api_tcp_443", Protocol: "TCP", Port: 443},
+		}, nil
+	})
+	patch2 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		if listener.SLBId != "slb-1" || backendPort != 30080 {
+			t.Errorf("unexpected update of %+v on port %d", listener, backendPort)
+		}
+		updated = append(updated, listener.ListenerId)
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+
+	c := &InCloud{}
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	if err := c.updateMembers(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 1 || updated[0] != "l-1" {
+		t.Fatalf("unexpected updates %v", updated)
+	}
+
+	// members are kept while there is no node to register
+	updated = nil
+	if err := c.updateMembers(context.TODO(), "kubernetes", service, nil); err != nil || len(updated) != 0 {
+		t.Fatalf("unexpected updates %v, %v", updated, err)
+	}
+}
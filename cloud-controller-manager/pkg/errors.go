@@ -0,0 +1,163 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// APIError is returned when keycloak or the SLB API answers with an unexpected status
+type APIError struct {
+	// Operation is the name of the api_client function that failed
+	Operation  string
+	StatusCode int
+	// Code and Message are taken from the error body returned by the API, if any
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s failed with status %d", e.Operation, e.StatusCode)
+	if e.Code != "" {
+		msg += ", code: " + e.Code
+	}
+	if e.Message != "" {
+		msg += ", message: " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += ", requestId: " + e.RequestID
+	}
+	return msg
+}
+
+// InvalidServiceError is returned when the Service cannot be reconciled until its spec or annotations are fixed
+type InvalidServiceError struct {
+	Reason string
+}
+
+func (e *InvalidServiceError) Error() string {
+	return "invalid service: " + e.Reason
+}
+
+// apiErrorBody covers the error bodies returned by the SLB API and keycloak
+type apiErrorBody struct {
+	Code             json.RawMessage `json:"code"`
+	ErrorCode        string          `json:"errorCode"`
+	Message          string          `json:"message"`
+	Msg              string          `json:"msg"`
+	RequestId        string          `json:"requestId"`
+	Error            string          `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+}
+
+// newAPIError builds an APIError from a failed response and its already read body
+func newAPIError(operation string, res *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		Operation:  operation,
+		StatusCode: res.StatusCode,
+		RequestID:  res.Header.Get("X-Request-Id"),
+	}
+	var eb apiErrorBody
+	if err := json.Unmarshal(body, &eb); err != nil {
+		apiErr.Message = redact(strings.TrimSpace(string(body)))
+		return apiErr
+	}
+	apiErr.Code = strings.Trim(string(eb.Code), `"`)
+	for _, s := range []string{eb.ErrorCode, eb.Error} {
+		if apiErr.Code == "" {
+			apiErr.Code = s
+		}
+	}
+	for _, s := range []string{eb.Message, eb.Msg, eb.ErrorDescription} {
+		if apiErr.Message == "" {
+			apiErr.Message = redact(s)
+		}
+	}
+	if eb.RequestId != "" {
+		apiErr.RequestID = eb.RequestId
+	}
+	return apiErr
+}
+
+// IsNotFoundError returns true if err means that the requested resource does not exist
+func IsNotFoundError(err error) bool {
+	if err == ErrorNotFoundInCloud {
+		return true
+	}
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflictError returns true if err means that the request conflicts with the current state
+// of the resource, for example a listener already using the port
+func IsConflictError(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// IsRetryableError returns true if the same request may succeed when sent again:
+// throttling, server side failures and transport errors
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests,
+			apiErr.StatusCode == http.StatusRequestTimeout,
+			apiErr.StatusCode >= http.StatusInternalServerError && apiErr.StatusCode != http.StatusNotImplemented:
+			return true
+		}
+		return false
+	}
+	return isTransportError(err)
+}
+
+// IsPermanentError returns true if retrying cannot succeed until the Service or the cloud
+// resources are changed, for example a wrong slbid, a rejected request or an exceeded quota
+func IsPermanentError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrorSlbIdNotDefined || err == ErrorNotFoundInCloud || err == ErrorLoadBalancerFailed {
+		return true
+	}
+	if _, ok := err.(*InvalidServiceError); ok {
+		return true
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		// 401 is left to the caller, the token may just have been revoked
+		return apiErr.StatusCode >= http.StatusBadRequest && apiErr.StatusCode < http.StatusInternalServerError &&
+			apiErr.StatusCode != http.StatusUnauthorized && apiErr.StatusCode != http.StatusConflict && !IsRetryableError(err)
+	}
+	return false
+}
+
+func isTransportError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*net.DNSError); ok {
+			return sysErr.Temporary()
+		}
+		return true
+	}
+	return strings.Contains(err.Error(), syscall.ECONNRESET.Error()) || strings.Contains(err.Error(), syscall.ECONNREFUSED.Error())
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	res := &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}}
+	res.Header.Set("X-Request-Id", "req-header")
+	apiErr := newAPIError("createListener", res, []byte(`{"code":"Slb.QuotaExceeded","message":"listener quota exceeded","requestId":"req-1"}`))
+	if apiErr.Code != "Slb.QuotaExceeded" || apiErr.Message != "listener quota exceeded" || apiErr.RequestID != "req-1" {
+		t.Fatalf("unexpected error %#v", apiErr)
+	}
+
+	apiErr = newAPIError("describeLoadBalancer", res, []byte("bad gateway"))
+	if apiErr.Message != "bad gateway" || apiErr.RequestID != "req-header" {
+		t.Fatalf("unexpected error %#v", apiErr)
+	}
+
+	apiErr = newAPIError("postKeycloakForm", res, []byte(`{"error":"invalid_client","error_description":"Invalid client secret"}`))
+	if apiErr.Code != "invalid_client" || apiErr.Message != "Invalid client secret" {
+		t.Fatalf("unexpected error %#v", apiErr)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	cases := []struct {
+		err                                      error
+		retryable, notFound, conflict, permanent bool
+	}{
+		{err: &APIError{StatusCode: http.StatusServiceUnavailable}, retryable: true},
+		{err: &APIError{StatusCode: http.StatusTooManyRequests}, retryable: true},
+		{err: &APIError{StatusCode: http.StatusNotFound}, notFound: true, permanent: true},
+		{err: &APIError{StatusCode: http.StatusConflict}, conflict: true},
+		{err: &APIError{StatusCode: http.StatusBadRequest}, permanent: true},
+		{err: &APIError{StatusCode: http.StatusUnauthorized}},
+		{err: ErrorSlbIdNotDefined, permanent: true},
+		{err: ErrorNotFoundInCloud, notFound: true, permanent: true},
+		{err: ErrorLoadBalancerFailed, permanent: true},
+		{err: &url.Error{Op: "Get", URL: "https://slb", Err: syscall.ECONNRESET}, retryable: true},
+		{err: errors.New("unmarshal failed")},
+	}
+	for _, c := range cases {
+		if IsRetryableError(c.err) != c.retryable || IsNotFoundError(c.err) != c.notFound ||
+			IsConflictError(c.err) != c.conflict || IsPermanentError(c.err) != c.permanent {
+			t.Errorf("unexpected classification of %v", c.err)
+		}
+	}
+}
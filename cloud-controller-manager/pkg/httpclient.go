@@ -0,0 +1,152 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	defaultRequestTimeout      = 30
+	defaultIdleConnTimeout     = 90
+	defaultMaxIdleConnsPerHost = 10
+	defaultDialTimeout         = 10 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// newHTTPClient builds the client shared by all keycloak and SLB requests of an InCloud.
+// Connections are pooled and kept alive, and server certificates are verified against
+// the configured CA bundle (or the system roots) unless insecure-skip-verify is set.
+func newHTTPClient(config Config) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy-url %q: %v", config.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(config.IdleConnTimeout) * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   time.Duration(config.RequestTimeout) * time.Second,
+	}, nil
+}
+
+func newTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.InsecureSkipVerify {
+		klog.Warningf("TLS certificate verification is disabled for keycloak and SLB requests")
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca-file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca-file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("cert-file and key-file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// apiClient is shared by all keycloak and SLB requests of an InCloud
+type apiClient struct {
+	httpClient *http.Client
+	// maxAttempts bounds the number of times a retryable request is sent
+	maxAttempts int
+	backoff     wait.Backoff
+	limiter     *rateLimiter
+	// auth signs the SLB requests, keycloak requests are left as is
+	auth authProvider
+}
+
+func newAPIClient(config Config) (*apiClient, error) {
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{
+		httpClient:  httpClient,
+		maxAttempts: config.RetryMaxAttempts,
+		backoff:     config.retryBackoff(),
+		limiter:     newRateLimiter(config),
+	}, nil
+}
+
+var (
+	fallbackHTTPClient     *http.Client
+	fallbackHTTPClientOnce sync.Once
+)
+
+// getFallbackHTTPClient returns a client with the default settings, shared by the providers
+// not built through newInCloud. Unlike http.DefaultClient, its requests time out.
+func getFallbackHTTPClient() *http.Client {
+	fallbackHTTPClientOnce.Do(func() {
+		config := Config{}
+		config.applyDefaults()
+		client, err := newHTTPClient(config)
+		if err != nil {
+			klog.Errorf("Failed to build the default http client: %v", err)
+			client = &http.Client{Timeout: defaultRequestTimeout * time.Second}
+		}
+		fallbackHTTPClient = client
+	})
+	return fallbackHTTPClient
+}
+
+// getAPIClient returns the shared client of config, or a client without retries
+// using the default http settings when the provider was not built through newInCloud
+func getAPIClient(config *InCloud) *apiClient {
+	config.cfgMu.RLock()
+	defer config.cfgMu.RUnlock()
+	if config.apiClient == nil {
+		return &apiClient{httpClient: getFallbackHTTPClient(), maxAttempts: 1}
+	}
+	return config.apiClient
+}
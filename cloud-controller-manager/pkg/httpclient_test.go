@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNewHTTPClientDefaults(t *testing.T) {
+	config := Config{}
+	config.applyDefaults()
+	client, err := newHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout.Seconds() != defaultRequestTimeout {
+		t.Fatalf("unexpected timeout %v", client.Timeout)
+	}
+	ac := &apiClient{httpClient: client}
+	if getAPIClient(&InCloud{apiClient: ac}) != ac {
+		t.Fatal("expected the shared client to be used")
+	}
+	if fallback := getAPIClient(&InCloud{}); fallback.httpClient.Timeout.Seconds() != defaultRequestTimeout {
+		t.Fatalf("unexpected timeout %v of the fallback client", fallback.httpClient.Timeout)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := newTLSConfig(Config{})
+	if err != nil || tlsConfig.InsecureSkipVerify {
+		t.Fatalf("expected verification to be enabled by default, %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+	if _, err := newTLSConfig(Config{CAFile: f.Name()}); err == nil {
+		t.Fatal("expected an error for a bundle without certificates")
+	}
+	if _, err := newTLSConfig(Config{CertFile: f.Name()}); err == nil {
+		t.Fatal("expected an error for a certificate without key")
+	}
+}
@@ -5,16 +5,19 @@
 package pkg
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
 	"io"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
 	corev1informer "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/cloud-provider"
 	"k8s.io/klog"
 	"os"
-	"strings"
+	"sync"
 )
 
 const (
@@ -27,9 +30,54 @@ type Config struct {
 	ClientSecret     string `gcfg:"client-secret"`
 	RequestedSubject string `gcfg:"requested-subject"`
 	TokenClientID    string `gcfg:"token-client-id"`
-	SubnetID         string `gcfg:"subnet-id"`  //由于loadbalancer本身不在cloud controller manager创建，不需要
-	SlbUrlPre        string `gcfg:"slbUrl-pre"` //cloud-config中配置slb url前缀；
+	SubnetID         string `gcfg:"subnet-id"`   //创建slb时默认使用的子网
+	SlbUrlPre        string `gcfg:"slbUrl-pre"`  //cloud-config中配置slb url前缀；
+	EipUrlPre        string `gcfg:"eipUrl-pre"`  //eip url前缀，用于释放controller创建的slb的eip
+	CertUrlPre       string `gcfg:"certUrl-pre"` //证书管理url前缀，用于上传HTTPS监听器的证书
+	AclUrlPre        string `gcfg:"aclUrl-pre"`  //访问控制url前缀，用于loadBalancerSourceRanges
 	KeycloakToken    string `gcfg:"kktoken"`
+
+	// defaults of the SLBs created for Services without slbid annotation
+	SlbScheme        string `gcfg:"slb-scheme"`
+	SlbSpecification string `gcfg:"slb-specification"`
+
+	// authentication of the SLB requests, see the AuthType constants
+	AuthType        string `gcfg:"auth-type"`
+	Audience        string `gcfg:"audience"`
+	AccessKeyID     string `gcfg:"access-key-id"`
+	SecretAccessKey string `gcfg:"secret-access-key"`
+
+	// Secret holding client-secret, kktoken and secret-access-key instead of this file, it is watched for rotation
+	SecretNamespace          string `gcfg:"secret-namespace"`
+	SecretName               string `gcfg:"secret-name"`
+	SecretClientSecretKey    string `gcfg:"secret-client-secret-key"`
+	SecretTokenKey           string `gcfg:"secret-token-key"`
+	SecretSecretAccessKeyKey string `gcfg:"secret-secret-access-key-key"`
+
+	// http client settings shared by keycloak and SLB requests
+	CAFile              string `gcfg:"ca-file"`
+	CertFile            string `gcfg:"cert-file"`
+	KeyFile             string `gcfg:"key-file"`
+	InsecureSkipVerify  bool   `gcfg:"insecure-skip-verify"`
+	ProxyURL            string `gcfg:"proxy-url"`
+	RequestTimeout      int    `gcfg:"request-timeout"`   //seconds
+	IdleConnTimeout     int    `gcfg:"idle-conn-timeout"` //seconds
+	MaxIdleConnsPerHost int    `gcfg:"max-idle-conns-per-host"`
+
+	// retries of failed requests
+	RetryMaxAttempts  int `gcfg:"retry-max-attempts"`
+	RetryInitialDelay int `gcfg:"retry-initial-delay"` //milliseconds
+	RetryMaxDelay     int `gcfg:"retry-max-delay"`     //milliseconds
+
+	// client side rate limiting, shared by all requests and per SLB
+	RateLimitQPS      float64 `gcfg:"rate-limit-qps"`
+	RateLimitBurst    int     `gcfg:"rate-limit-burst"`
+	SlbRateLimitQPS   float64 `gcfg:"slb-rate-limit-qps"`
+	SlbRateLimitBurst int     `gcfg:"slb-rate-limit-burst"`
+
+	// members of the listeners, NotReady and cordoned nodes are left out unless kept
+	KeepNotReadyNodes      bool `gcfg:"keep-not-ready-nodes"`
+	KeepUnschedulableNodes bool `gcfg:"keep-unschedulable-nodes"`
 }
 
 var _ cloudprovider.Interface = &InCloud{}
@@ -41,13 +89,43 @@ type InCloud struct {
 	clusterID       string
 	nodeInformer    corev1informer.NodeInformer
 	serviceInformer corev1informer.ServiceInformer
+	// endpointsInformer tells the nodes hosting the endpoints of the Services
+	endpointsInformer corev1informer.EndpointsInformer
+
+	// cluster name and nodes of the last sync of the service controller, used by the endpoints controller
+	syncMu            sync.RWMutex
+	syncedClusterName string
+	syncedNodes       []*v1.Node
+	synced            bool
+	serviceLocks      keyedMutex
+	kubeClient        kubernetes.Interface
+
+	// EIPs of the SLBs deleted for Services, by Service UID, until they are released. Also recorded
+	// on the Service, this one is kept for Services already removed from the apiserver.
+	eipMu       sync.Mutex
+	pendingEips map[types.UID]string
 
+	// cfgMu guards the settings swapped when the cloud-config is reloaded:
+	// the endpoints below, config, apiClient and auth
+	cfgMu            sync.RWMutex
 	LbUrlPre         string
-	KeycloakToken    string
 	RequestedSubject string
 	TokenClientID    string
-	ClientSecret     string
 	KeycloakUrl      string
+
+	// credentials may be rotated through the secret, access them with credentials()
+	credMu          sync.RWMutex
+	ClientSecret    string `json:"-"`
+	KeycloakToken   string `json:"-"`
+	SecretAccessKey string `json:"-"`
+
+	config Config
+	// configPath is the cloud-config file watched for changes, empty if it is not a file
+	configPath string
+
+	apiClient     *apiClient
+	auth          authProvider
+	eventRecorder record.EventRecorder
 }
 
 func init() {
@@ -56,79 +134,47 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		return newInCloud(cfg)
-	})
-}
-
-func readConfig(config io.Reader) (Config, error) {
-	if config == nil {
-		err := fmt.Errorf("no incloud provider config file given")
-		return Config{}, err
-	}
-
-	return LoadCloudCfg()
-}
-
-func LoadCloudCfg() (Config, error) {
-	fi, err := os.Open(DefaultCloudConfigPath)
-	if err != nil {
-		return Config{}, fmt.Errorf("load cloud config file: %v", err)
-	}
-	defer fi.Close()
-
-	var slbUrlPre, requestedSubject, tokenClientID, clientSecret, keycloakUrl, keycloakToken string
-	br := bufio.NewReader(fi)
-	for {
-		a, _, c := br.ReadLine()
-		if c == io.EOF {
-			break
+		cloud, err := newInCloud(cfg)
+		if err != nil {
+			return nil, err
 		}
-		arg := string(a)
-		if arg != "" && arg[0:1] != "#" && strings.Index(arg, "=") > 0 {
-			key := arg[0:strings.Index(arg, "=")]
-			value := arg[strings.Index(arg, "=")+1 : len(arg)]
-			switch key {
-			case "slbUrl-pre":
-				slbUrlPre = value
-			case "client-secret":
-				clientSecret = value
-			case "requested-subject":
-				requestedSubject = value
-			case "token-client-id":
-				tokenClientID = value
-			case "keycloakUrl":
-				keycloakUrl = value
-			case "kktoken":
-				keycloakToken = value
-			default:
-			}
+		if f, ok := config.(*os.File); ok {
+			cloud.(*InCloud).configPath = f.Name()
 		}
-	}
-	config := Config{keycloakUrl, clientSecret, requestedSubject,
-		tokenClientID, "", slbUrlPre, keycloakToken}
-	klog.Info(config)
-	return config, nil
+		return cloud, nil
+	})
 }
 
 // newInCloud returns a new instance of InCloud cloud provider.
 func newInCloud(config Config) (cloudprovider.Interface, error) {
+	apiClient, err := newAPIClient(config)
+	if err != nil {
+		return nil, err
+	}
 	qc := InCloud{
 		LbUrlPre:         config.SlbUrlPre,
 		KeycloakToken:    config.KeycloakToken,
 		RequestedSubject: config.RequestedSubject,
 		TokenClientID:    config.TokenClientID,
 		ClientSecret:     config.ClientSecret,
+		SecretAccessKey:  config.SecretAccessKey,
 		KeycloakUrl:      config.KeycloakUrl,
+		config:           config,
+		apiClient:        apiClient,
+	}
+	qc.auth, err = newAuthProvider(&qc, config)
+	if err != nil {
+		return nil, err
 	}
+	apiClient.auth = qc.auth
 
-	klog.Infof("InCloud provider init done")
-	b, _ := json.Marshal(&qc)
-	klog.Infof("InCloud is :%v", string(b))
+	klog.Infof("InCloud provider init done, config: %v", config)
 	return &qc, nil
 }
 
 func (ic *InCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	clientset := clientBuilder.ClientOrDie("do-shared-informers")
+	ic.kubeClient = clientset
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
 	nodeinformer := sharedInformer.Core().V1().Nodes()
 	go nodeinformer.Informer().Run(stop)
@@ -137,6 +183,66 @@ func (ic *InCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilde
 	serviceInformer := sharedInformer.Core().V1().Services()
 	go serviceInformer.Informer().Run(stop)
 	ic.serviceInformer = serviceInformer
+
+	endpointsInformer := sharedInformer.Core().V1().Endpoints()
+	endpointsController := newEndpointsController(ic, endpointsInformer)
+	go endpointsInformer.Informer().Run(stop)
+	ic.endpointsInformer = endpointsInformer
+	go endpointsController.Run(stop)
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	ic.eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "incloud-cloud-provider"})
+
+	config := ic.currentConfig()
+	if config.SecretName != "" {
+		ic.watchCredentialsSecret(clientset, config, stop)
+	}
+	if ic.configPath != "" {
+		ic.watchCloudConfig(ic.configPath, stop)
+	}
+	// without certificate API there are no HTTPS listeners, the TLS Secrets are not cached
+	if config.CertUrlPre != "" {
+		ic.watchCertificateSecrets(clientset, stop)
+	}
+}
+
+// currentConfig returns the cloud-config in use
+func (ic *InCloud) currentConfig() Config {
+	ic.cfgMu.RLock()
+	defer ic.cfgMu.RUnlock()
+	return ic.config
+}
+
+// slbUrlPre returns the prefix of the SLB API urls
+func (ic *InCloud) slbUrlPre() string {
+	ic.cfgMu.RLock()
+	defer ic.cfgMu.RUnlock()
+	return ic.LbUrlPre
+}
+
+// keycloakClient returns the keycloak endpoint and the identities tokens are requested for
+func (ic *InCloud) keycloakClient() (keycloakUrl, tokenClientID, requestedSubject string) {
+	ic.cfgMu.RLock()
+	defer ic.cfgMu.RUnlock()
+	return ic.KeycloakUrl, ic.TokenClientID, ic.RequestedSubject
+}
+
+// authProvider returns the provider authenticating the SLB requests, nil if the
+// provider was not built through newInCloud
+func (ic *InCloud) authProvider() authProvider {
+	ic.cfgMu.RLock()
+	defer ic.cfgMu.RUnlock()
+	return ic.auth
+}
+
+// recordServiceEvent records an event on service, it is a no-op before Initialize
+func (ic *InCloud) recordServiceEvent(service *v1.Service, eventtype, reason, message string) {
+	if ic.eventRecorder == nil {
+		return
+	}
+	ic.eventRecorder.Event(service, eventtype, reason, message)
 }
 
 func (ic *InCloud) Clusters() (cloudprovider.Clusters, bool) {
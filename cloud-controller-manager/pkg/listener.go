@@ -1,8 +1,11 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	"regexp"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -11,13 +14,36 @@ import (
 
 type Protocol string
 
+// healthCheckTypeUDP is the only health check of UDP listeners, whatever the healthcheck-type annotation
+const healthCheckTypeUDP = "udp"
+
+// health check of the listeners of Services with externalTrafficPolicy Local, whatever the
+// healthcheck annotations: kube-proxy answers on the healthCheckNodePort of the Service, with
+// 200 on the nodes hosting ready endpoints of the Service and 503 on the others
+const (
+	healthCheckTypeHTTP  = "http"
+	localHealthCheckPath = "/healthz"
+)
+
+// session persistence of the listeners
+const (
+	PersistenceNone          = "none"
+	PersistenceSourceIP      = "source_ip"
+	PersistenceInsertCookie  = "insert_cookie"
+	PersistenceRewriteCookie = "rewrite_cookie"
+
+	cookiePersistenceInsert  = "insert"
+	cookiePersistenceRewrite = "rewrite"
+)
+
 const (
 	ProtocolTCP   Protocol = "TCP"
+	ProtocolUDP   Protocol = "UDP"
 	ProtocolHTTP  Protocol = "HTTP"
 	ProtocolHTTPS Protocol = "HTTPS"
 )
 
-//返回结构体
+// 返回结构体
 type Listener struct {
 	SLBId         string `json:"slbId"`
 	ListenerId    string `json:"listenerId"`
@@ -26,10 +52,12 @@ type Listener struct {
 	Port          int    `json:"port"`
 	ForwardRule   string `json:"forwardRule"`
 	IsHealthCheck string `json:"isHealthCheck"`
+	CertificateId string `json:"certificateId"`
+	AclStatus     string `json:"aclStatus"`
 	BackendServer []*BackendServer
 }
 
-//创建结构体,和Listener不一样
+// 创建结构体,和Listener不一样
 type CreateListenerOpts struct {
 	SLBId              string   `json:"slbId"`
 	ListenerName       string   `json:"listenerName"`
@@ -38,18 +66,30 @@ type CreateListenerOpts struct {
 	ForwardRule        string   `json:"forwardRule"`
 	IsHealthCheck      string   `json:"isHealthCheck"`
 	TypeHealthCheck    string   `json:"typeHealthCheck"`
-	PortHealthCheck    int      `json:"portHealthCheck""`
+	PortHealthCheck    int      `json:"portHealthCheck"`
 	PeriodHealthCheck  int      `json:"periodHealthCheck"`
 	TimeoutHealthCheck int      `json:"timeoutHealthCheck"`
 	MaxHealthCheck     int      `json:"maxHealthCheck"`
 	DomainHealthCheck  string   `json:"domainHealthCheck"`
 	PathHealthCheck    string   `json:"pathHealthCheck"`
+	// health checks of UDP listeners
+	RequestHealthCheck  string `json:"requestHealthCheck,omitempty"`
+	ResponseHealthCheck string `json:"responseHealthCheck,omitempty"`
+	CertificateId       string `json:"certificateId,omitempty"`
+	// session persistence, see the Persistence constants
+	SessionPersistence string `json:"sessionPersistence"`
+	PersistenceTimeout int    `json:"persistenceTimeout,omitempty"`
+	CookieName         string `json:"cookieName,omitempty"`
+	// access control, see acl.go
+	AclStatus string `json:"aclStatus"`
+	AclId     string `json:"aclId,omitempty"`
+	AclType   string `json:"aclType,omitempty"`
 }
 
 // GetListeners use should mannually load listener because sometimes we do not need load entire topology. For example, deletion
-//GetListeners get listeners by slbid
-func GetListeners(config *InCloud, service *corev1.Service) ([]Listener, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+// GetListeners get listeners by slbid
+func GetListeners(ctx context.Context, config *InCloud, service *corev1.Service) ([]Listener, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
@@ -57,7 +97,7 @@ func GetListeners(config *InCloud, service *corev1.Service) ([]Listener, error)
 	if slbid == "" {
 		return nil, ErrorSlbIdNotDefined
 	}
-	ls, err := describeListenersBySlbId(config.LbUrlPre, token, slbid)
+	ls, err := describeListenersBySlbId(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid)
 	if err != nil {
 		return nil, err
 	}
@@ -69,9 +109,9 @@ func GetListeners(config *InCloud, service *corev1.Service) ([]Listener, error)
 	return ls, nil
 }
 
-//GetListener get listener by listenerid
-func GetListener(config *InCloud, service *corev1.Service, listenerId string) (*Listener, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+// GetListener get listener by listenerid
+func GetListener(ctx context.Context, config *InCloud, service *corev1.Service, listenerId string) (*Listener, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
@@ -79,7 +119,7 @@ func GetListener(config *InCloud, service *corev1.Service, listenerId string) (*
 	if slbid == "" {
 		return nil, ErrorSlbIdNotDefined
 	}
-	ls, err := describeListenerByListnerId(config.LbUrlPre, token, slbid, listenerId)
+	ls, err := describeListenerByListnerId(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, listenerId)
 	if err != nil {
 		return nil, err
 	}
@@ -89,50 +129,172 @@ func GetListener(config *InCloud, service *corev1.Service, listenerId string) (*
 	return ls, nil
 }
 
-// get listener for a port or nil if does not exist
+// get listener for a port or nil if does not exist. Listeners listen on the port of the Service,
+// their members on its NodePort. HTTP and HTTPS listeners serve TCP ports.
 func GetListenerForPort(existingListeners []Listener, port corev1.ServicePort) *Listener {
 	for _, l := range existingListeners {
-		if strings.ToLower(l.Protocol) == strings.ToLower(string(port.Protocol)) && l.Port == int(port.NodePort) {
+		if transportProtocol(l.Protocol) == port.Protocol && l.Port == int(port.Port) {
 			return &l
 		}
 	}
 	return nil
 }
 
-func CreateListener(config *InCloud, opts CreateListenerOpts) (*Listener, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+// transportProtocol returns the protocol of the Service ports served by listeners of protocol
+func transportProtocol(protocol string) corev1.Protocol {
+	if strings.EqualFold(protocol, string(corev1.ProtocolUDP)) {
+		return corev1.ProtocolUDP
+	}
+	return corev1.ProtocolTCP
+}
+
+// getListenerProtocols parses the protocol-port annotation of service, e.g. "https:443,http:web",
+// into the listener protocols of the Service ports. Ports are given by number or by name.
+// ServicePort.AppProtocol is not read, it is not part of the vendored k8s.io/api.
+func getListenerProtocols(service *corev1.Service) (map[int32]Protocol, error) {
+	protocols := make(map[int32]Protocol)
+	value := getServiceAnnotation(service, common.ServiceAnnotationLBProtocolPort, "")
+	if value == "" {
+		return protocols, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: %q is not <protocol>:<port>",
+				common.ServiceAnnotationLBProtocolPort, item)}
+		}
+		protocol := Protocol(strings.ToUpper(strings.TrimSpace(parts[0])))
+		if protocol != ProtocolHTTP && protocol != ProtocolHTTPS && protocol != ProtocolTCP {
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: protocol %q is not http, https or tcp",
+				common.ServiceAnnotationLBProtocolPort, parts[0])}
+		}
+		port := findServicePort(service, strings.TrimSpace(parts[1]))
+		if port == nil || port.Protocol != corev1.ProtocolTCP {
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: %q is not a TCP port of the service",
+				common.ServiceAnnotationLBProtocolPort, parts[1])}
+		}
+		if p, ok := protocols[port.Port]; ok && p != protocol {
+			return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: port %d is given protocols %s and %s",
+				common.ServiceAnnotationLBProtocolPort, port.Port, p, protocol)}
+		}
+		protocols[port.Port] = protocol
+	}
+	return protocols, nil
+}
+
+// getListenerProtocol returns the protocol of the listener of port
+func getListenerProtocol(protocols map[int32]Protocol, port corev1.ServicePort) Protocol {
+	if protocol, ok := protocols[port.Port]; ok && port.Protocol == corev1.ProtocolTCP {
+		return protocol
+	}
+	return Protocol(port.Protocol)
+}
+
+// setSessionPersistence sets the session persistence of opts, a listener of service. ClientIP affinity
+// of the Service keeps clients on a member by source IP, for TCP and UDP listeners, or by cookie for
+// HTTP and HTTPS listeners, which may be configured through the cookie-persistence annotations.
+func setSessionPersistence(opts *CreateListenerOpts, service *corev1.Service) error {
+	opts.SessionPersistence, opts.PersistenceTimeout, opts.CookieName = PersistenceNone, 0, ""
+	timeout := int(corev1.DefaultClientIPServiceAffinitySeconds)
+	if config := service.Spec.SessionAffinityConfig; config != nil && config.ClientIP != nil && config.ClientIP.TimeoutSeconds != nil {
+		timeout = int(*config.ClientIP.TimeoutSeconds)
+	}
+	clientIP := service.Spec.SessionAffinity == corev1.ServiceAffinityClientIP
+
+	if opts.Protocol != ProtocolHTTP && opts.Protocol != ProtocolHTTPS {
+		if clientIP {
+			opts.SessionPersistence, opts.PersistenceTimeout = PersistenceSourceIP, timeout
+		}
+		return nil
+	}
+
+	cookie := strings.ToLower(getServiceAnnotation(service, common.ServiceAnnotationLBCookiePersistence, ""))
+	if cookie == "" && clientIP {
+		cookie = cookiePersistenceInsert
+	}
+	switch cookie {
+	case "":
+	case cookiePersistenceInsert:
+		if value := getServiceAnnotation(service, common.ServiceAnnotationLBCookieTimeout, ""); value != "" {
+			t, err := strconv.Atoi(value)
+			if err != nil || t <= 0 {
+				return &InvalidServiceError{Reason: fmt.Sprintf("annotation %s must be a number of seconds, got %q",
+					common.ServiceAnnotationLBCookieTimeout, value)}
+			}
+			timeout = t
+		}
+		opts.SessionPersistence, opts.PersistenceTimeout = PersistenceInsertCookie, timeout
+	case cookiePersistenceRewrite:
+		name := getServiceAnnotation(service, common.ServiceAnnotationLBCookieName, "")
+		if name == "" {
+			return &InvalidServiceError{Reason: fmt.Sprintf("rewrite cookie persistence needs the annotation %s",
+				common.ServiceAnnotationLBCookieName)}
+		}
+		opts.SessionPersistence, opts.CookieName = PersistenceRewriteCookie, name
+	default:
+		return &InvalidServiceError{Reason: fmt.Sprintf("annotation %s must be %s or %s, got %q",
+			common.ServiceAnnotationLBCookiePersistence, cookiePersistenceInsert, cookiePersistenceRewrite, cookie)}
+	}
+	return nil
+}
+
+// findServicePort returns the TCP port of service whose number or name is nameOrPort, or any port
+// with that number or name if none is TCP
+func findServicePort(service *corev1.Service, nameOrPort string) *corev1.ServicePort {
+	var found *corev1.ServicePort
+	for i, p := range service.Spec.Ports {
+		if p.Name != nameOrPort && strconv.Itoa(int(p.Port)) != nameOrPort {
+			continue
+		}
+		if p.Protocol == corev1.ProtocolTCP {
+			return &service.Spec.Ports[i]
+		}
+		found = &service.Spec.Ports[i]
+	}
+	return found
+}
+
+// isLocalTrafficPolicy returns true if service only sends external traffic to the endpoints on the node receiving it
+func isLocalTrafficPolicy(service *corev1.Service) bool {
+	return service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// setLocalHealthCheck makes opts health check the healthCheckNodePort of service, see localHealthCheckPath
+func setLocalHealthCheck(opts *CreateListenerOpts, service *corev1.Service) {
+	opts.IsHealthCheck = "1"
+	opts.TypeHealthCheck = healthCheckTypeHTTP
+	opts.PortHealthCheck = int(service.Spec.HealthCheckNodePort)
+	opts.PathHealthCheck = localHealthCheckPath
+	opts.DomainHealthCheck = ""
+}
+
+func CreateListener(ctx context.Context, config *InCloud, opts CreateListenerOpts) (*Listener, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
-	return createListener(config.LbUrlPre, token, opts)
+	return createListener(ctx, getAPIClient(config), config.slbUrlPre(), token, opts)
 }
 
-func UpdateListener(config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+func UpdateListener(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
-	return modifyListener(config.LbUrlPre, token, listenerid, opts)
+	return modifyListener(ctx, getAPIClient(config), config.slbUrlPre(), token, listenerid, opts)
 }
 
-func (l *Listener) DeleteListener(config *InCloud, service *corev1.Service) error {
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+// DeleteListener deletes the listener from the SLB slbid, a listener already deleted is not an error
+func (l *Listener) DeleteListener(ctx context.Context, config *InCloud, slbid string) error {
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return error
 	}
-	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
-	if slbid == "" {
-		return ErrorSlbIdNotDefined
-	}
-	error = deleteListener(config.LbUrlPre, token, slbid, l.ListenerId)
-	if nil != error {
+	error = deleteListener(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, l.ListenerId)
+	if error != nil && !IsNotFoundError(error) {
 		klog.Errorf("Deleting LoadBalancerListener:%v", error)
+		return error
 	}
-	//if l.Status == nil {
-	//	return fmt.Errorf("Could not delete noexit listener")
-	//}
-	//klog.Infof("Deleting LoadBalancerListener :'%s'", *l.Status.LoadBalancerListenerID)
-	//return l.listenerExec.DeleteListener(*l.Status.LoadBalancerListenerID)
 	return nil
 }
 
@@ -145,6 +307,34 @@ func checkPortInService(service *corev1.Service, port int) *corev1.ServicePort {
 	return nil
 }
 
-func GetListenerPrefix(service *corev1.Service) string {
-	return fmt.Sprintf("listener_%s_%s_", service.Namespace, service.Name)
+// GetListenerPrefix returns the prefix of the names of the listeners owned by service
+func GetListenerPrefix(clusterName string, service *corev1.Service) string {
+	return fmt.Sprintf("listener_%s_%s_%s_", clusterName, service.Namespace, service.Name)
+}
+
+// GetListenerName returns the name of the listener of port
+func GetListenerName(clusterName string, service *corev1.Service, port corev1.ServicePort) string {
+	return GetListenerPrefix(clusterName, service) + fmt.Sprintf("%s_%d", strings.ToLower(string(port.Protocol)), port.Port)
+}
+
+// listenerName matches the names given by GetListenerName. Namespaces and Service names are DNS
+// labels without '_', the cluster name, which may have some, is everything before them: matching
+// the prefix of cluster a and Service b/c would also match the listeners of cluster a_b and Service c/d.
+var listenerName = regexp.MustCompile(`^listener_(.+)_([^_]+)_([^_]+)_[a-z]+_\d+$`)
+
+// legacyListenerName matches the listener_<nodePort>_<index> names given by older releases,
+// whose listeners listened on the NodePort
+var legacyListenerName = regexp.MustCompile(`^listener_(\d+)_\d+$`)
+
+// IsOwnedBy returns true if the listener was created for service by the controller of clusterName.
+// Listeners named by older releases are owned by the Service using their NodePort.
+func (l *Listener) IsOwnedBy(clusterName string, service *corev1.Service) bool {
+	if m := listenerName.FindStringSubmatch(l.ListenerName); m != nil {
+		return m[1] == clusterName && m[2] == service.Namespace && m[3] == service.Name
+	}
+	if m := legacyListenerName.FindStringSubmatch(l.ListenerName); m != nil {
+		nodePort, _ := strconv.Atoi(m[1])
+		return checkPortInService(service, nodePort) != nil
+	}
+	return false
 }
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/agiledragon/gomonkey"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetListenerProtocols(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "web", Port: 80, Protocol: v1.ProtocolTCP},
+			{Name: "tls", Port: 443, Protocol: v1.ProtocolTCP},
+			{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+		}},
+	}
+	service.Annotations["loadbalancer.inspur.com/protocol-port"] = "https:443, HTTP:web"
+	protocols, err := getListenerProtocols(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocols[443] != ProtocolHTTPS || protocols[80] != ProtocolHTTP ||
+		getListenerProtocol(protocols, service.Spec.Ports[2]) != ProtocolUDP {
+		t.Fatalf("unexpected protocols %v", protocols)
+	}
+
+	for _, value := range []string{"https", "ftp:80", "https:8443", "http:53", "http:dns", "http:80,https:web"} {
+		service.Annotations["loadbalancer.inspur.com/protocol-port"] = value
+		if _, err := getListenerProtocols(service); !IsPermanentError(err) {
+			t.Errorf("%s: expected an invalid service error, got %v", value, err)
+		}
+	}
+}
+
+func TestSupportsProtocol(t *testing.T) {
+	network := &LoadBalancer{SlbType: "Network"}
+	if !network.SupportsProtocol(ProtocolUDP) || network.SupportsProtocol(ProtocolHTTPS) {
+		t.Fatal("network SLBs only forward TCP and UDP")
+	}
+	for _, lb := range []*LoadBalancer{{SlbType: SlbTypeApplication}, {}} {
+		if !lb.SupportsProtocol(ProtocolHTTP) {
+			t.Errorf("%q SLB should support HTTP", lb.SlbType)
+		}
+	}
+}
+
+func TestSetSessionPersistence(t *testing.T) {
+	timeout := int32(600)
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+		Spec: v1.ServiceSpec{
+			SessionAffinity:       v1.ServiceAffinityClientIP,
+			SessionAffinityConfig: &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}},
+		},
+	}
+	tcp := &CreateListenerOpts{Protocol: ProtocolTCP}
+	http := &CreateListenerOpts{Protocol: ProtocolHTTP}
+	for _, opts := range []*CreateListenerOpts{tcp, http} {
+		if err := setSessionPersistence(opts, service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tcp.SessionPersistence != PersistenceSourceIP || tcp.PersistenceTimeout != 600 {
+		t.Fatalf("unexpected TCP persistence %+v", tcp)
+	}
+	if http.SessionPersistence != PersistenceInsertCookie || http.PersistenceTimeout != 600 {
+		t.Fatalf("unexpected HTTP persistence %+v", http)
+	}
+
+	service.Annotations["loadbalancer.inspur.com/cookie-persistence"] = "rewrite"
+	service.Annotations["loadbalancer.inspur.com/cookie-name"] = "SESSION"
+	if err := setSessionPersistence(http, service); err != nil {
+		t.Fatal(err)
+	}
+	if http.SessionPersistence != PersistenceRewriteCookie || http.CookieName != "SESSION" || http.PersistenceTimeout != 0 {
+		t.Fatalf("unexpected HTTP persistence %+v", http)
+	}
+
+	// persistence is turned off with the affinity
+	service.Spec.SessionAffinity = v1.ServiceAffinityNone
+	if err := setSessionPersistence(tcp, service); err != nil || tcp.SessionPersistence != PersistenceNone {
+		t.Fatalf("unexpected TCP persistence %+v, %v", tcp, err)
+	}
+
+	invalid := []map[string]string{
+		{"loadbalancer.inspur.com/cookie-persistence": "sticky"},
+		{"loadbalancer.inspur.com/cookie-persistence": "rewrite"},
+		{"loadbalancer.inspur.com/cookie-persistence": "insert", "loadbalancer.inspur.com/cookie-timeout": "-1"},
+	}
+	for _, annotations := range invalid {
+		service.Annotations = annotations
+		if err := setSessionPersistence(http, service); !IsPermanentError(err) {
+			t.Errorf("%v: expected an invalid service error, got %v", annotations, err)
+		}
+	}
+}
+
+func TestListenerIsOwnedBy(t *testing.T) {
+	service := func(namespace, name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	port := v1.ServicePort{Port: 80, Protocol: v1.ProtocolTCP}
+	l := &Listener{ListenerName: GetListenerName("a_b", service("c", "d"), port)}
+	if !l.IsOwnedBy("a_b", service("c", "d")) {
+		t.Fatalf("%s not owned by its Service", l.ListenerName)
+	}
+	if l.IsOwnedBy("a", service("b", "c")) || l.IsOwnedBy("a_b", service("c", "d-e")) {
+		t.Fatalf("%s owned by another Service", l.ListenerName)
+	}
+}
+
+func TestDeleteListener(t *testing.T) {
+	var status int
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(deleteListener, func(ctx context.Context, client *apiClient, url, token, slbId, listnerId string) error {
+		if slbId != "slb-1" {
+			t.Errorf("listener deleted from SLB %s", slbId)
+		}
+		if status != 0 {
+			return &APIError{Operation: "deleteListener", StatusCode: status}
+		}
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+
+	listener := &Listener{ListenerId: "l-1"}
+	for _, test := range []struct {
+		status int
+		fails  bool
+	}{{0, false}, {http.StatusNotFound, false}, {http.StatusInternalServerError, true}} {
+		status = test.status
+		if err := listener.DeleteListener(context.TODO(), &InCloud{}, "slb-1"); (err != nil) != test.fails {
+			t.Errorf("status %d: unexpected error %v", test.status, err)
+		}
+	}
+}
@@ -5,12 +5,38 @@ import (
 	"fmt"
 	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	corev1lister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+	"strings"
+	"time"
 )
 
 var (
 	ErrorNotFoundInCloud = fmt.Errorf("Cannot find lb in incloud")
 	ErrorSlbIdNotDefined = fmt.Errorf("Could not find Service SLB Id ")
+	// ErrorLoadBalancerFailed is returned for an SLB which failed to be created, it never becomes active
+	ErrorLoadBalancerFailed = fmt.Errorf("lb is in error state in incloud")
+)
+
+const (
+	SchemeInternetFacing = "internet-facing"
+	SchemeInternal       = "internal"
+
+	defaultSlbScheme = SchemeInternetFacing
+
+	// tags of the SLBs created by the controller
+	TagKeyCluster    = "kubernetes.io/cluster"
+	TagKeyServiceUID = "kubernetes.io/service-uid"
+
+	// slbType of the SLBs, network SLBs only forward TCP and UDP
+	SlbTypeApplication = "application"
+	SlbTypeNetwork     = "network"
+
+	slbStateActive  = "active"
+	slbStateError   = "error"
+	slbWaitInterval = 5 * time.Second
+	slbWaitTimeout  = 3 * time.Minute
 )
 
 type LoadBalancer struct {
@@ -39,6 +65,20 @@ type LoadBalancer struct {
 	SlbType           string `json:"slbType"`
 	State             string `json:"state"`
 	UserId            string `json:"userId"`
+	Tags              []Tag  `json:"tags"`
+}
+
+type Tag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type CreateLoadBalancerOpts struct {
+	SlbName         string `json:"slbName"`
+	Scheme          string `json:"scheme"`
+	SubnetId        string `json:"subnetId"`
+	SpecificationId string `json:"specificationId,omitempty"`
+	Tags            []Tag  `json:"tags,omitempty"`
 }
 
 type LoadBalancerStatus struct {
@@ -54,18 +94,18 @@ type NewLoadBalancerOption struct {
 	ClusterName string
 }
 
-//GetLoadBalancer by slbid,use incloud api to get lb in cloud, return err if not found
-func GetLoadBalancer(config *InCloud, service *v1.Service) (*LoadBalancer, error) {
+// GetLoadBalancer by slbid,use incloud api to get lb in cloud, return err if not found
+func GetLoadBalancer(ctx context.Context, config *InCloud, service *v1.Service) (*LoadBalancer, error) {
 	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
 	if slbid == "" {
 		return nil, ErrorSlbIdNotDefined
 	}
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
 
-	lb, err := describeLoadBalancer(config.LbUrlPre, token, slbid)
+	lb, err := describeLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid)
 	if err != nil {
 		return nil, err
 	}
@@ -75,16 +115,16 @@ func GetLoadBalancer(config *InCloud, service *v1.Service) (*LoadBalancer, error
 	return lb, nil
 }
 
-func ModifyLoadBalancer(config *InCloud, service *v1.Service, slbName string) (*SlbResponse, error) {
+func ModifyLoadBalancer(ctx context.Context, config *InCloud, service *v1.Service, slbName string) (*SlbResponse, error) {
 	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
 	if slbid == "" {
 		return nil, ErrorSlbIdNotDefined
 	}
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return nil, error
 	}
-	slbResponse, err := modifyLoadBalancer(config.LbUrlPre, token, slbid, slbName)
+	slbResponse, err := modifyLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid, slbName)
 	if err != nil {
 		return nil, err
 	}
@@ -94,19 +134,158 @@ func ModifyLoadBalancer(config *InCloud, service *v1.Service, slbName string) (*
 	return slbResponse, nil
 }
 
-func DeleteLoadBalancer(config *InCloud, service *v1.Service) error {
+func DeleteLoadBalancer(ctx context.Context, config *InCloud, service *v1.Service) error {
 	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
 	if slbid == "" {
 		return ErrorSlbIdNotDefined
 	}
-	token, error := getKeyCloakToken(config.RequestedSubject, config.TokenClientID, config.ClientSecret, config.KeycloakUrl, config)
+	token, error := getToken(ctx, config)
 	if error != nil {
 		return error
 	}
-	error = deleteLoadBalancer(config.LbUrlPre, token, slbid)
+	error = deleteLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid)
 	return error
 }
 
+// FindLoadBalancersByName returns the SLBs named slbName
+func FindLoadBalancersByName(ctx context.Context, config *InCloud, slbName string) ([]LoadBalancer, error) {
+	token, error := getToken(ctx, config)
+	if error != nil {
+		return nil, error
+	}
+	return describeLoadBalancersByName(ctx, getAPIClient(config), config.slbUrlPre(), token, slbName)
+}
+
+func CreateLoadBalancer(ctx context.Context, config *InCloud, opts CreateLoadBalancerOpts) (*LoadBalancer, error) {
+	token, error := getToken(ctx, config)
+	if error != nil {
+		return nil, error
+	}
+	return createLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, opts)
+}
+
+// ReleaseEip releases the EIP eipid, which must not be bound anymore
+func ReleaseEip(ctx context.Context, config *InCloud, eipid string) error {
+	eipUrlPre := config.currentConfig().EipUrlPre
+	if eipUrlPre == "" {
+		return fmt.Errorf("cloud config key eipUrl-pre is not set, EIP %s is not released", eipid)
+	}
+	token, error := getToken(ctx, config)
+	if error != nil {
+		return error
+	}
+	return releaseEip(ctx, getAPIClient(config), eipUrlPre, token, eipid)
+}
+
+// WaitLoadBalancerDeleted polls the SLB slbid until it is gone, ctx is done or slbWaitTimeout expires
+func WaitLoadBalancerDeleted(ctx context.Context, config *InCloud, slbid string) error {
+	ctx, cancel := context.WithTimeout(ctx, slbWaitTimeout)
+	defer cancel()
+	err := wait.PollImmediateUntil(slbWaitInterval, func() (bool, error) {
+		token, err := getToken(ctx, config)
+		if err != nil {
+			return false, err
+		}
+		_, err = describeLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid)
+		if IsNotFoundError(err) {
+			return true, nil
+		}
+		return false, nil
+	}, ctx.Done())
+	if err != nil {
+		return fmt.Errorf("SLB %s is not deleted: %v", slbid, err)
+	}
+	return nil
+}
+
+// WaitLoadBalancerActive polls the SLB slbid until it is active, ctx is done or slbWaitTimeout expires.
+// Permanent errors, such as the SLB being gone or in error state, are returned as is without waiting.
+func WaitLoadBalancerActive(ctx context.Context, config *InCloud, slbid string) (*LoadBalancer, error) {
+	ctx, cancel := context.WithTimeout(ctx, slbWaitTimeout)
+	defer cancel()
+	var lb *LoadBalancer
+	var permanent error
+	err := wait.PollImmediateUntil(slbWaitInterval, func() (bool, error) {
+		token, err := getToken(ctx, config)
+		if err != nil {
+			return false, err
+		}
+		lb, err = describeLoadBalancer(ctx, getAPIClient(config), config.slbUrlPre(), token, slbid)
+		if err == nil && strings.EqualFold(lb.State, slbStateError) {
+			klog.Errorf("SLB %s is in state %s", slbid, lb.State)
+			err = ErrorLoadBalancerFailed
+		}
+		if IsPermanentError(err) {
+			permanent = err
+			return false, err
+		}
+		if err != nil {
+			// retried until the timeout
+			return false, nil
+		}
+		return lb.IsActive(), nil
+	}, ctx.Done())
+	if permanent != nil {
+		return nil, permanent
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SLB %s is not active: %v", slbid, err)
+	}
+	return lb, nil
+}
+
+// IsActive returns true once the SLB accepts listeners
+func (lb *LoadBalancer) IsActive() bool {
+	return strings.EqualFold(lb.State, slbStateActive)
+}
+
+// SupportsProtocol returns false if lb cannot have listeners of protocol. The protocols of
+// SLBs of unknown type are left to the API to check.
+func (lb *LoadBalancer) SupportsProtocol(protocol Protocol) bool {
+	if !strings.EqualFold(lb.SlbType, SlbTypeNetwork) {
+		return true
+	}
+	return protocol == ProtocolTCP || protocol == ProtocolUDP
+}
+
+// IsOwnedBy returns true if the SLB was created by the controller of clusterName for service
+func (lb *LoadBalancer) IsOwnedBy(clusterName string, service *v1.Service) bool {
+	var cluster, uid string
+	for _, tag := range lb.Tags {
+		switch tag.Key {
+		case TagKeyCluster:
+			cluster = tag.Value
+		case TagKeyServiceUID:
+			uid = tag.Value
+		}
+	}
+	return cluster == clusterName && uid == string(service.UID)
+}
+
+// ownerTags are the tags of the SLB created for service by the controller of clusterName
+func ownerTags(clusterName string, service *v1.Service) []Tag {
+	return []Tag{
+		{Key: TagKeyCluster, Value: clusterName},
+		{Key: TagKeyServiceUID, Value: string(service.UID)},
+	}
+}
+
+// defaultLoadBalancerName is the name of the SLB created for service, unless it is annotated
+func defaultLoadBalancerName(clusterName string, service *v1.Service) string {
+	return fmt.Sprintf("k8s-%s-%s", clusterName, service.UID)
+}
+
+// withSlbId returns a copy of service annotated with slbid, for the functions looking the SLB
+// up through the annotation
+func withSlbId(service *v1.Service, slbid string) *v1.Service {
+	service = service.DeepCopy()
+	if service.Annotations == nil {
+		service.Annotations = map[string]string{}
+	}
+	service.Annotations[common.ServiceAnnotationInternalSlbId] = slbid
+	return service
+}
+
 // GetNodesInstanceIDs return resource ids for listener to create backends
 func (lb *LoadBalancer) GetNodesInstanceIDs() []string {
 	//if len(lb.Nodes) == 0 {
@@ -2,22 +2,23 @@ package pkg
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
-	"io/ioutil"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/cloud-provider"
 	"k8s.io/klog"
 	"net/http"
-	"os/exec"
 	"strconv"
+	"strings"
 )
 
 // LoadBalancer returns an implementation of LoadBalancer for InCloud.
 func (ic *InCloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
-	klog.Info("LoadBalancer() called")
+	klog.V(logLevelPayloads).Info("LoadBalancer() called")
 	return ic, true
 }
 
@@ -25,7 +26,7 @@ func (ic *InCloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 // if so, what its status is.
 func (ic *InCloud) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
 	//TODO 此处约定为从service yaml的annotation取slbid
-	lb, err := GetLoadBalancer(ic, service)
+	lb, err := ic.getLoadBalancer(ctx, service)
 	if err != nil {
 		if err == ErrorSlbIdNotDefined {
 			klog.Infof("Service:%s/%s isn't inspur loadbalancer type", service.Namespace, service.Name)
@@ -45,8 +46,8 @@ func (ic *InCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 
 // GetLoadBalancerName returns the name of the load balancer. Implementations must treat the
 // *v1.Service parameter as read-only and not modify it.
-func (ic *InCloud) GetLoadBalancerName(_ context.Context, clusterName string, service *v1.Service) string {
-	lb, err := GetLoadBalancer(ic, service)
+func (ic *InCloud) GetLoadBalancerName(ctx context.Context, clusterName string, service *v1.Service) string {
+	lb, err := ic.getLoadBalancer(ctx, service)
 	if err != nil {
 		if err == ErrorSlbIdNotDefined {
 			klog.Infof("Service:%s/%s isn't inspur loadbalancer type", service.Namespace, service.Name)
@@ -63,22 +64,42 @@ func (ic *InCloud) GetLoadBalancerName(_ context.Context, clusterName string, se
 // parameters as read-only and not modify them.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 // by inspur
-// 这里不创建LoadBalancer，查询LoadBalancer，有则创建Listener以及backend，无则报错
+// 没有slbid注解时创建LoadBalancer并将slbid记录到service注解，然后创建Listener以及backend
 // 改进点：根据service查询后端pod所在节点，只注册pod所在节点到loadbalancer上，当pod漂移时，需要刷新loadbalancer的member；当pod个数变更时，需要刷新loadbalancer的member
 func (ic *InCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	lb, err := GetLoadBalancer(ic, service)
+	ic.recordSync(clusterName, nodes)
+	defer ic.serviceLocks.Lock(serviceKey(service))()
+	status, err := ic.ensureLoadBalancer(ctx, clusterName, service, nodes)
 	if err != nil {
-		if err == ErrorSlbIdNotDefined {
-			klog.Infof("Service:%s/%s isn't inspur loadbalancer type", service.Namespace, service.Name)
-			return &v1.LoadBalancerStatus{}, nil
+		if ic.isPermanentLoadBalancerError(service, "EnsureLoadBalancer", err) {
+			// keep the current status, the Service will be synced again once it is changed
+			return service.Status.LoadBalancer.DeepCopy(), nil
 		}
-		klog.Errorf("Failed to call 'GetLoadBalancer' of service:%s/%s,error:%v", service.Namespace, service.Name, err)
 		return nil, err
 	}
+	return status, nil
+}
 
-	ls, err := GetListeners(ic, service)
+func (ic *InCloud) ensureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	lb, err := ic.getLoadBalancer(ctx, service)
+	if err == ErrorSlbIdNotDefined {
+		lb, err = ic.provisionLoadBalancer(ctx, clusterName, service)
+		if err != nil {
+			return nil, err
+		}
+		// the listeners are looked up through the annotation, service itself must not be modified
+		service = withSlbId(service, lb.SlbId)
+	} else if err != nil {
+		klog.Errorf("Failed to call 'GetLoadBalancer' of service:%s/%s,error:%v", service.Namespace, service.Name, err)
+		return nil, err
+	} else if !lb.IsActive() && lb.IsOwnedBy(clusterName, service) {
+		// created by a previous sync which gave up waiting
+		if lb, err = WaitLoadBalancerActive(ctx, ic, lb.SlbId); err != nil {
+			return nil, err
+		}
+	}
 
-	svcNodes, erro := getServiceNodes(service, nodes)
+	svcNodes, erro := ic.getServiceNodes(service, nodes)
 	if erro != nil {
 		return nil, erro
 	}
@@ -86,6 +107,28 @@ func (ic *InCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 		return nil, fmt.Errorf("there are no available nodes for LoadBalancer service %s/%s", service.Namespace, service.Name)
 	}
 	klog.Infof("EnsureLoadBalancer(%v,%v,%v,%v,%v)", clusterName, service.Namespace, service.Name, len(nodes), len(svcNodes))
+
+	if err := ic.ensureListeners(ctx, clusterName, service, lb, svcNodes); err != nil {
+		return nil, err
+	}
+
+	status := &v1.LoadBalancerStatus{}
+	status.Ingress = []v1.LoadBalancerIngress{{IP: lb.BusinessIp}}
+	if lb.EipAddress != "" {
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: lb.EipAddress})
+	}
+	return status, nil
+}
+
+// ensureListeners creates or updates the listener of every port of service on lb and registers
+// nodes as its members on the NodePort of the port. Listeners are named after the cluster and the Service (see GetListenerPrefix),
+// the listeners of other Services sharing lb are never modified: a port already used by one of them
+// is reported on the Service and skipped.
+func (ic *InCloud) ensureListeners(ctx context.Context, clusterName string, service *v1.Service, lb *LoadBalancer, nodes []*v1.Node) error {
+	ls, err := GetListeners(ctx, ic, service)
+	if err != nil {
+		return err
+	}
 	//verify scheme 负载均衡的网络模式，默认参数：internet-facing：公网（默认）internal：内网
 
 	forwardRule := getServiceAnnotation(service, common.ServiceAnnotationLBForwardRule, "RR")
@@ -102,77 +145,319 @@ func (ic *InCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 	ma, _ := strconv.Atoi(getServiceAnnotation(service, common.ServiceAnnotationLBmaxHealthCheck, "1"))
 	do := getServiceAnnotation(service, common.ServiceAnnotationLBdomainHealthCheck, "")
 	pa := getServiceAnnotation(service, common.ServiceAnnotationLBpathHealthCheck, "/")
+	udpReq := getServiceAnnotation(service, common.ServiceAnnotationLBrequestHealthCheck, "")
+	udpResp := getServiceAnnotation(service, common.ServiceAnnotationLBresponseHealthCheck, "")
 	//verify ports
 	ports := service.Spec.Ports
 	if len(ports) == 0 {
-		return nil, fmt.Errorf("no ports provided for inspur load balancer")
+		return fmt.Errorf("no ports provided for inspur load balancer")
+	}
+	protocols, err := getListenerProtocols(service)
+	if err != nil {
+		return err
+	}
+	if isLocalTrafficPolicy(service) && service.Spec.HealthCheckNodePort == 0 {
+		return &InvalidServiceError{Reason: "externalTrafficPolicy Local needs a healthCheckNodePort"}
+	}
+	for _, port := range ports {
+		if port.Protocol != v1.ProtocolTCP && port.Protocol != v1.ProtocolUDP {
+			return &InvalidServiceError{Reason: fmt.Sprintf("port %d: protocol %s is not supported", port.Port, port.Protocol)}
+		}
+		protocol := getListenerProtocol(protocols, port)
+		if !lb.SupportsProtocol(protocol) {
+			return &InvalidServiceError{Reason: fmt.Sprintf("port %d: %s listeners are not supported by the %s SLB %s",
+				port.Port, protocol, lb.SlbType, lb.SlbId)}
+		}
+		// rejected before any listener is changed
+		if err := setSessionPersistence(&CreateListenerOpts{Protocol: protocol}, service); err != nil {
+			return err
+		}
+	}
+	weights, err := ic.getBackendWeights(service, nodes)
+	if err != nil {
+		return err
+	}
+	cidrs, err := getSourceRanges(service)
+	if err != nil {
+		return err
+	}
+	aclType, err := getAclType(service)
+	if err != nil {
+		return err
+	}
+	var acl *Acl
+	if len(cidrs) > 0 {
+		if acl, err = EnsureAcl(ctx, ic, service, cidrs); err != nil {
+			return err
+		}
+	}
+	var cert *Certificate
+	for _, protocol := range protocols {
+		if protocol == ProtocolHTTPS {
+			if cert, err = ic.ensureServiceCertificate(ctx, service); err != nil {
+				return err
+			}
+			break
+		}
 	}
 	//create/update Listener
-	for portIndex, port := range ports {
-		klog.Infof("GetListenerForPort,ls%v,port%v", ls, port)
+	var conflicts []string
+	inUse := make(map[string]bool)
+	for _, port := range ports {
+		klog.V(logLevelPayloads).Infof("GetListenerForPort,ls%v,port%v", ls, port)
 		listener := GetListenerForPort(ls, port)
-		po := port.NodePort
+		po := port.Port
+		if listener != nil && !listener.IsOwnedBy(clusterName, service) {
+			conflicts = append(conflicts, fmt.Sprintf("%s/%d (listener %s)", port.Protocol, po, listener.ListenerName))
+			continue
+		}
+		protocol := getListenerProtocol(protocols, port)
+		if listener != nil {
+			inUse[listener.ListenerId] = true
+			if !strings.EqualFold(listener.Protocol, string(protocol)) {
+				klog.Infof("Replacing %s listener %s by a %s listener", listener.Protocol, listener.ListenerName, protocol)
+				if err := ic.deleteListenerAndBackends(ctx, service, lb.SlbId, listener); err != nil {
+					// the port is still held by the listener, the new one is created by the next sync
+					return err
+				}
+				listener = nil
+			}
+		}
+		opts := CreateListenerOpts{
+			SLBId:              lb.SlbId,
+			ListenerName:       GetListenerName(clusterName, service, port),
+			Protocol:           protocol,
+			Port:               po,
+			ForwardRule:        forwardRule,
+			IsHealthCheck:      hcs,
+			TypeHealthCheck:    ty,
+			PortHealthCheck:    hpo,
+			PeriodHealthCheck:  pr,
+			TimeoutHealthCheck: ti,
+			MaxHealthCheck:     ma,
+			DomainHealthCheck:  do,
+			PathHealthCheck:    pa,
+		}
+		if protocol == ProtocolHTTPS {
+			opts.CertificateId = cert.CertificateId
+		}
+		if protocol == ProtocolUDP {
+			// UDP listeners cannot be health checked over HTTP, even with externalTrafficPolicy Local:
+			// their members are the nodes hosting endpoints
+			opts.TypeHealthCheck = healthCheckTypeUDP
+			opts.DomainHealthCheck, opts.PathHealthCheck = "", ""
+			opts.RequestHealthCheck, opts.ResponseHealthCheck = udpReq, udpResp
+		} else if isLocalTrafficPolicy(service) {
+			setLocalHealthCheck(&opts, service)
+		}
+		if err := setSessionPersistence(&opts, service); err != nil {
+			return err
+		}
+		opts.AclStatus = aclStatusOff
+		if acl != nil {
+			opts.AclStatus, opts.AclId, opts.AclType = aclStatusOn, acl.AclId, aclType
+		}
 
 		//port not assigned
 		if listener == nil {
 			klog.Infof("Creating listener for port %d", po)
-			listener, err = CreateListener(ic, CreateListenerOpts{
-				SLBId:              lb.SlbId,
-				ListenerName:       fmt.Sprintf("listener_%d_%d", int(po), portIndex),
-				Protocol:           Protocol(port.Protocol),
-				Port:               po,
-				ForwardRule:        forwardRule,
-				IsHealthCheck:      hcs,
-				TypeHealthCheck:    ty,
-				PortHealthCheck:    hpo,
-				PeriodHealthCheck:  pr,
-				TimeoutHealthCheck: ti,
-				MaxHealthCheck:     ma,
-				DomainHealthCheck:  do,
-				PathHealthCheck:    pa,
-			})
+			listener, err = CreateListener(ctx, ic, opts)
 			if err != nil {
-				// Unknown error, retry later
-				return nil, fmt.Errorf("error creating LB listener: %v", err)
+				klog.Errorf("error creating LB listener for port %d: %v", po, err)
+				return err
 			}
 		} else {
+			// listeners named by older releases are renamed here
 			klog.Infof("Updating listener for port %d", po)
-			_, erro := UpdateListener(ic, listener.ListenerId, CreateListenerOpts{
-				SLBId:              lb.SlbId,
-				ListenerName:       fmt.Sprintf("listener_%d_%d", int(po), portIndex),
-				Protocol:           Protocol(port.Protocol),
-				Port:               po,
-				ForwardRule:        forwardRule,
-				IsHealthCheck:      hcs,
-				TypeHealthCheck:    ty,
-				PortHealthCheck:    hpo,
-				PeriodHealthCheck:  pr,
-				TimeoutHealthCheck: ti,
-				MaxHealthCheck:     ma,
-				DomainHealthCheck:  do,
-				PathHealthCheck:    pa,
-			})
+			_, erro := UpdateListener(ctx, ic, listener.ListenerId, opts)
 			if erro != nil {
-				return nil, fmt.Errorf("Error updating LB listener: %v", err)
+				klog.Errorf("error updating LB listener %s: %v", listener.ListenerId, erro)
+				return erro
 			}
 
 		}
-		cls, err := GetListener(ic, service, listener.ListenerId)
+		cls, err := GetListener(ctx, ic, service, listener.ListenerId)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get LB listener: %v", listener.ListenerId)
+			klog.Errorf("failed to get LB listener %s: %v", listener.ListenerId, err)
+			return err
 		}
-		err = UpdateBackends(ic, cls, svcNodes)
+		err = UpdateBackends(ctx, ic, cls, int(port.NodePort), nodes, weights)
 		if err != nil {
+			return err
+		}
+	}
+
+	// listeners of ports removed from the Service, and the listeners of older releases listening on
+	// the NodePort, which are deleted once the listener on the Service port is serving
+	var removed []string
+	var deleteErr error
+	for i := range ls {
+		listener := &ls[i]
+		if inUse[listener.ListenerId] || !listener.IsOwnedBy(clusterName, service) {
+			continue
+		}
+		klog.Infof("Deleting listener %s of port %d, which is not used by service:%s/%s anymore", listener.ListenerName,
+			listener.Port, service.Namespace, service.Name)
+		if err := ic.deleteListenerAndBackends(ctx, service, lb.SlbId, listener); err != nil {
+			// retried by the next sync
+			deleteErr = err
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("%s/%d", listener.Protocol, listener.Port))
+	}
+	if len(removed) > 0 {
+		ic.recordServiceEvent(service, v1.EventTypeNormal, "DeletedListeners", fmt.Sprintf("Deleted the listeners of ports %s from SLB %s",
+			strings.Join(removed, ", "), lb.SlbId))
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	// the access control list, once loadBalancerSourceRanges are cleared and the listeners unbound.
+	// Only looked up while a listener of the Service had it bound before this sync, one failing to be
+	// deleted then is deleted with the Service.
+	if acl == nil && ic.currentConfig().AclUrlPre != "" && hasAclListener(clusterName, service, ls) {
+		if err := DeleteAcl(ctx, ic, service); err != nil {
+			klog.Warningf("Failed to delete the access control list of service:%s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+
+	// certificates replaced by a rotation, or not used anymore, by a Service with HTTPS listeners now or before this sync
+	if ic.currentConfig().CertUrlPre != "" && (cert != nil || hasCertificateListener(clusterName, service, ls)) {
+		keep := ""
+		if cert != nil {
+			keep = cert.CertificateId
+		}
+		if err := DeleteCertificates(ctx, ic, service, keep); err != nil {
+			klog.Warningf("Failed to delete the certificates of service:%s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		msg := fmt.Sprintf("ports %s of SLB %s are used by listeners of other services", strings.Join(conflicts, ", "), lb.SlbId)
+		ic.recordServiceEvent(service, v1.EventTypeWarning, "ListenerPortConflict", msg)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// provisionLoadBalancer creates the SLB of a Service without slbid annotation, records its
+// id on the Service and waits for it to be active. The SLB is tagged with the cluster and the
+// Service UID, so that one created by a previous sync which failed to record it is reused.
+func (ic *InCloud) provisionLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*LoadBalancer, error) {
+	config := ic.currentConfig()
+	opts := CreateLoadBalancerOpts{
+		SlbName:         getServiceAnnotation(service, common.ServiceAnnotationLBName, defaultLoadBalancerName(clusterName, service)),
+		Scheme:          getServiceAnnotation(service, common.ServiceAnnotationLBScheme, config.SlbScheme),
+		SubnetId:        getServiceAnnotation(service, common.ServiceAnnotationLBSubnetId, config.SubnetID),
+		SpecificationId: getServiceAnnotation(service, common.ServiceAnnotationLBSpecification, config.SlbSpecification),
+		Tags:            ownerTags(clusterName, service),
+	}
+	if opts.SubnetId == "" {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("no slbid annotation, and neither the %s annotation nor the subnet-id cloud config key is set to create one",
+			common.ServiceAnnotationLBSubnetId)}
+	}
+	if opts.Scheme != SchemeInternetFacing && opts.Scheme != SchemeInternal {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s must be %s or %s, got %q",
+			common.ServiceAnnotationLBScheme, SchemeInternetFacing, SchemeInternal, opts.Scheme)}
+	}
+
+	lb, err := ic.findOwnedLoadBalancer(ctx, clusterName, service)
+	if err != nil {
+		return nil, err
+	}
+	if lb != nil {
+		klog.Infof("Found SLB %s created for service:%s/%s by a previous sync", lb.SlbId, service.Namespace, service.Name)
+	} else {
+		klog.Infof("Creating SLB %s for service:%s/%s", opts.SlbName, service.Namespace, service.Name)
+		if lb, err = CreateLoadBalancer(ctx, ic, opts); err != nil {
 			return nil, err
 		}
+		ic.recordServiceEvent(service, v1.EventTypeNormal, "CreatedLoadBalancer", fmt.Sprintf("Created SLB %s (%s)", opts.SlbName, lb.SlbId))
 	}
 
-	status := &v1.LoadBalancerStatus{}
-	status.Ingress = []v1.LoadBalancerIngress{{IP: lb.BusinessIp}}
-	if lb.EipAddress != "" {
-		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: lb.EipAddress})
+	if err := ic.patchServiceAnnotations(service, map[string]interface{}{
+		common.ServiceAnnotationInternalSlbId:      lb.SlbId,
+		common.ServiceAnnotationLBProvisionedSlbId: lb.SlbId,
+	}); err != nil {
+		return nil, fmt.Errorf("record SLB %s on service:%s/%s: %v", lb.SlbId, service.Namespace, service.Name, err)
 	}
-	return status, nil
+	return WaitLoadBalancerActive(ctx, ic, lb.SlbId)
+}
+
+// getLoadBalancer returns the SLB of the slbid annotation of service. An SLB created by the
+// controller which is not found anymore is reported as ErrorSlbIdNotDefined, it is created
+// again by EnsureLoadBalancer.
+func (ic *InCloud) getLoadBalancer(ctx context.Context, service *v1.Service) (*LoadBalancer, error) {
+	lb, err := GetLoadBalancer(ctx, ic, service)
+	if IsNotFoundError(err) && isProvisionedLoadBalancer(service) {
+		klog.Infof("SLB %s created for service:%s/%s is gone", getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, ""),
+			service.Namespace, service.Name)
+		return nil, ErrorSlbIdNotDefined
+	}
+	return lb, err
+}
+
+// isProvisionedLoadBalancer returns true if the slbid annotation of service is an SLB created by the controller
+func isProvisionedLoadBalancer(service *v1.Service) bool {
+	slbid := getServiceAnnotation(service, common.ServiceAnnotationInternalSlbId, "")
+	return slbid != "" && slbid == getServiceAnnotation(service, common.ServiceAnnotationLBProvisionedSlbId, "")
+}
+
+// forgetLoadBalancer removes the annotations recording the SLB released for service, a
+// Service changed back to type LoadBalancer gets a new one
+func (ic *InCloud) forgetLoadBalancer(service *v1.Service) {
+	err := ic.removeServiceAnnotations(service, common.ServiceAnnotationInternalSlbId, common.ServiceAnnotationLBProvisionedSlbId)
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("Failed to remove the slbid of service:%s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// findOwnedLoadBalancer returns the SLB created for service by the controller of clusterName,
+// nil if there is none
+func (ic *InCloud) findOwnedLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*LoadBalancer, error) {
+	slbName := getServiceAnnotation(service, common.ServiceAnnotationLBName, defaultLoadBalancerName(clusterName, service))
+	existing, err := FindLoadBalancersByName(ctx, ic, slbName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range existing {
+		if existing[i].IsOwnedBy(clusterName, service) {
+			return &existing[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// setServiceAnnotation sets the annotation key of service to value in the apiserver
+func (ic *InCloud) setServiceAnnotation(service *v1.Service, key, value string) error {
+	return ic.patchServiceAnnotations(service, map[string]interface{}{key: value})
+}
+
+// removeServiceAnnotations removes the annotations keys of service in the apiserver
+func (ic *InCloud) removeServiceAnnotations(service *v1.Service, keys ...string) error {
+	annotations := make(map[string]interface{})
+	for _, key := range keys {
+		// removed by the merge patch
+		annotations[key] = nil
+	}
+	return ic.patchServiceAnnotations(service, annotations)
+}
+
+func (ic *InCloud) patchServiceAnnotations(service *v1.Service, annotations map[string]interface{}) error {
+	if ic.kubeClient == nil {
+		return fmt.Errorf("kubernetes client is not initialized")
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ic.kubeClient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch)
+	return err
 }
 
 // UpdateLoadBalancer updates hosts under the specified load balancer.
@@ -180,7 +465,17 @@ func (ic *InCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 // parameters as read-only and not modify them.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (ic *InCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	lb, err := GetLoadBalancer(ic, service)
+	ic.recordSync(clusterName, nodes)
+	defer ic.serviceLocks.Lock(serviceKey(service))()
+	err := ic.updateLoadBalancer(ctx, clusterName, service, nodes)
+	if err != nil && ic.isPermanentLoadBalancerError(service, "UpdateLoadBalancer", err) {
+		return nil
+	}
+	return err
+}
+
+func (ic *InCloud) updateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	lb, err := ic.getLoadBalancer(ctx, service)
 	if err != nil {
 		if err == ErrorSlbIdNotDefined {
 			klog.Infof("Service:%s/%s isn't inspur loadbalancer type", service.Namespace, service.Name)
@@ -190,7 +485,7 @@ func (ic *InCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, s
 		return err
 	}
 
-	svcNodes, erro := getServiceNodes(service, nodes)
+	svcNodes, erro := ic.getServiceNodes(service, nodes)
 	if erro != nil {
 		return erro
 	}
@@ -201,69 +496,7 @@ func (ic *InCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, s
 
 	//修改负载均衡信息，目前只支持修改名称。
 
-	ls, err := GetListeners(ic, service)
-	//verify scheme 负载均衡的网络模式，默认参数：internet-facing：公网（默认）internal：内网
-
-	forwardRule := getServiceAnnotation(service, common.ServiceAnnotationLBForwardRule, "RR")
-	healthCheck := getServiceAnnotation(service, common.ServiceAnnotationLBHealthCheck, "0")
-	hc, _ := strconv.ParseBool(healthCheck)
-	hcs := "0"
-	if hc {
-		hcs = "1"
-	}
-
-	//verify ports
-	ports := service.Spec.Ports
-	if len(ports) == 0 {
-		return fmt.Errorf("no ports provided for inspur load balancer")
-	}
-	//create/update Listener
-	for portIndex, port := range ports {
-		listener := GetListenerForPort(ls, port)
-		po := port.NodePort
-		//port not assigned
-		if listener == nil {
-			klog.Infof("Creating listener for port %d", po)
-			listener, err = CreateListener(ic, CreateListenerOpts{
-				SLBId:         lb.SlbId,
-				ListenerName:  fmt.Sprintf("listener_%d_%d", int(po), portIndex),
-				Protocol:      Protocol(port.Protocol),
-				Port:          po,
-				ForwardRule:   forwardRule,
-				IsHealthCheck: hcs,
-			})
-			if err != nil {
-				// Unknown error, retry later
-				return fmt.Errorf("error creating LB listener: %v", err)
-			}
-
-		} else {
-			klog.Infof("Updating listener for port %d", po)
-			_, erro := UpdateListener(ic, listener.ListenerId, CreateListenerOpts{
-				SLBId:         lb.SlbId,
-				ListenerName:  fmt.Sprintf("listener_%d_%d", int(po), portIndex),
-				Protocol:      Protocol(port.Protocol),
-				Port:          port.NodePort,
-				ForwardRule:   forwardRule,
-				IsHealthCheck: hcs,
-			})
-			if erro != nil {
-				return fmt.Errorf("Error updating LB listener: %v", err)
-			}
-
-		}
-		cls, err := GetListener(ic, service, listener.ListenerId)
-		if err != nil {
-			return fmt.Errorf("failed to get LB listener: %v", listener.ListenerId)
-		}
-		UpdateBackends(ic, cls, svcNodes)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return ic.ensureListeners(ctx, clusterName, service, lb, svcNodes)
 }
 
 // EnsureLoadBalancerDeleted deletes the specified load balancer if it
@@ -277,13 +510,33 @@ func (ic *InCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, s
 func (ic *InCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
 	klog.Infof("EnsureLoadBalancerDeleted(%v, %v, %v, %v, %v)", clusterName, service.Namespace, service.Name,
 		service.Spec.LoadBalancerIP, service.Spec.Ports)
+	defer ic.serviceLocks.Lock(serviceKey(service))()
 
-	lb, error := GetLoadBalancer(ic, service)
-	if error != nil {
-		if error == ErrorSlbIdNotDefined {
+	lb, error := ic.getLoadBalancer(ctx, service)
+	if error == ErrorSlbIdNotDefined {
+		// an SLB created by a previous sync may not have been recorded on the Service
+		lb, error = ic.findOwnedLoadBalancer(ctx, clusterName, service)
+		if error != nil {
+			return error
+		}
+		if lb == nil {
 			klog.Infof("Service:%s/%s isn't inspur loadbalancer type", service.Namespace, service.Name)
+			if err := ic.releasePendingEip(ctx, service); err != nil {
+				return err
+			}
+			if isProvisionedLoadBalancer(service) {
+				// released by a previous sync which failed to forget it
+				ic.forgetLoadBalancer(service)
+			}
 			return nil
 		}
+		service = withSlbId(service, lb.SlbId)
+	} else if error != nil {
+		if IsNotFoundError(error) {
+			klog.Infof("loadbalancer of service:%s/%s is already gone", service.Namespace, service.Name)
+			// deleted by a previous sync which failed to release its EIP
+			return ic.releasePendingEip(ctx, service)
+		}
 		klog.Errorf("Failed to call 'GetLoadBalancer' of service:%s/%s,error:%v", service.Namespace, service.Name, error)
 		return error
 	}
@@ -291,131 +544,291 @@ func (ic *InCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName st
 		klog.Infof("there is no such loadbalancer")
 		return nil
 	}
-	ls, err := GetListeners(ic, service)
+	ls, err := GetListeners(ctx, ic, service)
 	if err != nil {
 		klog.Infof("get ls fail ,error : %v", err)
 		return err
 	}
 
-	//verify ports
-	ports := service.Spec.Ports
-	if len(ports) == 0 {
-		return fmt.Errorf("no ports provided for inspur load balancer")
+	// only the listeners of the Service are removed, other Services may share the SLB through
+	// their slbid annotation, even one created by the controller
+	var listeners []*Listener
+	foreign := 0
+	for i := range ls {
+		if ls[i].IsOwnedBy(clusterName, service) {
+			listeners = append(listeners, &ls[i])
+		} else {
+			foreign++
+		}
+	}
+	// the EIP could not be released once the SLB is gone, nothing is deleted until it can be
+	if lb.IsOwnedBy(clusterName, service) && foreign == 0 && lb.EipId != "" && ic.currentConfig().EipUrlPre == "" {
+		err := &InvalidServiceError{Reason: fmt.Sprintf("cloud config key eipUrl-pre is not set, SLB %s and its EIP %s cannot be released",
+			lb.SlbId, lb.EipAddress)}
+		ic.recordServiceEvent(service, v1.EventTypeWarning, "ReleaseEipFailed", err.Error())
+		return err
 	}
 	//the delete order : backend,ls,lb
-	for _, port := range ports {
-		listener := GetListenerForPort(ls, port)
-		//port not assigned
-		if listener != nil {
-			backends, err := GetBackends(ic, lb.SlbId, listener.ListenerId)
-			if nil != err {
-				klog.Errorf("getBackens fail ,error : %v", err)
-				return err
-			}
-			if nil != backends {
-				var backStringList []string
-				for _, backend := range backends {
-					backStringList = append(backStringList, backend.BackendId)
-				}
-				DeleteBackends(ic, lb.SlbId, listener.ListenerId, backStringList)
-			}
-			error = listener.DeleteListener(ic, service)
-			if nil != error {
-				klog.Infof("DeleteListener fail ,error : %v", err)
-				return err
-			}
+	for _, listener := range listeners {
+		if err := ic.deleteListenerAndBackends(ctx, service, lb.SlbId, listener); err != nil {
+			return err
+		}
+	}
+	if ic.currentConfig().CertUrlPre != "" {
+		if err := DeleteCertificates(ctx, ic, service, ""); err != nil {
+			klog.Warningf("Failed to delete the certificates of service:%s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+	if ic.currentConfig().AclUrlPre != "" {
+		if err := DeleteAcl(ctx, ic, service); err != nil {
+			klog.Warningf("Failed to delete the access control list of service:%s/%s: %v", service.Namespace, service.Name, err)
 		}
 	}
+	if !lb.IsOwnedBy(clusterName, service) {
+		return nil
+	}
+	// SLBs created by the controller are released with their EIP, once no other Service uses them
+	if foreign > 0 {
+		msg := fmt.Sprintf("SLB %s created for the service is kept, %d listeners of other services are still on it", lb.SlbId, foreign)
+		klog.Warningf("service:%s/%s: %s", service.Namespace, service.Name, msg)
+		ic.recordServiceEvent(service, v1.EventTypeWarning, "LoadBalancerInUse", msg)
+		return nil
+	}
+	return ic.releaseLoadBalancer(ctx, service, lb)
+}
+
+// deleteListenerAndBackends deletes listener of the SLB slbid, after its members
+func (ic *InCloud) deleteListenerAndBackends(ctx context.Context, service *v1.Service, slbid string, listener *Listener) error {
+	backends, err := GetBackends(ctx, ic, slbid, listener.ListenerId)
+	if nil != err {
+		klog.Errorf("getBackens fail ,error : %v", err)
+		return err
+	}
+	if len(backends) > 0 {
+		var backStringList []string
+		for _, backend := range backends {
+			backStringList = append(backStringList, backend.BackendId)
+		}
+		if err := DeleteBackends(ctx, ic, slbid, listener.ListenerId, backStringList); err != nil {
+			return err
+		}
+	}
+	if err := listener.DeleteListener(ctx, ic, slbid); err != nil {
+		klog.Infof("DeleteListener fail ,error : %v", err)
+		return err
+	}
+	return nil
+}
+
+// releaseLoadBalancer deletes lb, an SLB created by the controller for service, and its EIP.
+// The EIP is recorded before the SLB is deleted, a sync failing to release it leaves it to the
+// next one, which does not find the SLB anymore.
+func (ic *InCloud) releaseLoadBalancer(ctx context.Context, service *v1.Service, lb *LoadBalancer) error {
+	klog.Infof("Deleting SLB %s created for service:%s/%s", lb.SlbId, service.Namespace, service.Name)
+	if lb.EipId != "" {
+		ic.recordPendingEip(service, lb.EipId)
+	}
+	if err := DeleteLoadBalancer(ctx, ic, service); err != nil && !IsNotFoundError(err) {
+		return err
+	}
+	if lb.EipId == "" {
+		ic.forgetLoadBalancer(service)
+		return nil
+	}
+	// the EIP is bound until the deletion is done
+	if err := WaitLoadBalancerDeleted(ctx, ic, lb.SlbId); err != nil {
+		return err
+	}
+	if err := ic.releasePendingEip(ctx, service); err != nil {
+		return err
+	}
+	ic.forgetLoadBalancer(service)
 	return nil
 }
 
-//getServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
+// releasePendingEip releases the EIP of the SLB deleted for service, if any
+func (ic *InCloud) releasePendingEip(ctx context.Context, service *v1.Service) error {
+	eipid := ic.pendingEip(service)
+	if eipid == "" {
+		return nil
+	}
+	klog.Infof("Releasing EIP %s of the SLB deleted for service:%s/%s", eipid, service.Namespace, service.Name)
+	if err := ReleaseEip(ctx, ic, eipid); err != nil && !IsNotFoundError(err) {
+		ic.recordServiceEvent(service, v1.EventTypeWarning, "ReleaseEipFailed", fmt.Sprintf("Failed to release EIP %s: %v", eipid, err))
+		return err
+	}
+	ic.forgetPendingEip(service)
+	return nil
+}
+
+// pendingEip returns the EIP left to release for service, empty if there is none
+func (ic *InCloud) pendingEip(service *v1.Service) string {
+	ic.eipMu.Lock()
+	defer ic.eipMu.Unlock()
+	if eipid, ok := ic.pendingEips[service.UID]; ok {
+		return eipid
+	}
+	return getServiceAnnotation(service, common.ServiceAnnotationLBEipId, "")
+}
+
+// recordPendingEip records eipid as the EIP left to release for service, in memory and on the
+// Service, unless it is already removed from the apiserver
+func (ic *InCloud) recordPendingEip(service *v1.Service, eipid string) {
+	ic.eipMu.Lock()
+	if ic.pendingEips == nil {
+		ic.pendingEips = make(map[types.UID]string)
+	}
+	ic.pendingEips[service.UID] = eipid
+	ic.eipMu.Unlock()
+	if err := ic.setServiceAnnotation(service, common.ServiceAnnotationLBEipId, eipid); err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("Failed to record EIP %s on service:%s/%s: %v", eipid, service.Namespace, service.Name, err)
+	}
+}
+
+// forgetPendingEip forgets the EIP released for service
+func (ic *InCloud) forgetPendingEip(service *v1.Service) {
+	ic.eipMu.Lock()
+	delete(ic.pendingEips, service.UID)
+	ic.eipMu.Unlock()
+	if getServiceAnnotation(service, common.ServiceAnnotationLBEipId, "") == "" {
+		return
+	}
+	if err := ic.removeServiceAnnotations(service, common.ServiceAnnotationLBEipId); err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("Failed to remove the EIP of service:%s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// isPermanentLoadBalancerError reports err of a load balancer operation on service. It returns
+// true for errors which cannot be fixed by retrying, those are recorded as a warning event on
+// the Service and should not be returned to the service controller, which would retry forever.
+func (ic *InCloud) isPermanentLoadBalancerError(service *v1.Service, operation string, err error) bool {
+	if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusUnauthorized && ic.authProvider() != nil {
+		// the cached token may have been revoked, get a new one on retry
+		ic.authProvider().Invalidate()
+	}
+	if !IsPermanentError(err) {
+		klog.Errorf("%s of service:%s/%s failed, will retry: %v", operation, service.Namespace, service.Name, err)
+		return false
+	}
+	klog.Errorf("%s of service:%s/%s failed permanently: %v", operation, service.Namespace, service.Name, err)
+	ic.recordServiceEvent(service, v1.EventTypeWarning, "SyncLoadBalancerFailed", fmt.Sprintf("%s failed permanently: %v", operation, err))
+	return true
+}
+
+// getServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
 func getServiceAnnotation(service *v1.Service, annotationKey string, defaultSetting string) string {
-	klog.Infof("getServiceAnnotation(%v, %v, %v)", service, annotationKey, defaultSetting)
+	klog.V(logLevelPayloads).Infof("getServiceAnnotation(%v, %v, %v)", serviceKey(service), annotationKey, defaultSetting)
 	if annotationValue, ok := service.Annotations[annotationKey]; ok {
 		//if there is an annotation for this setting, set the "setting" var to it
 		// annotationValue can be empty, it is working as designed
 		// it makes possible for instance provisioning loadbalancer without floatingip
-		klog.Infof("Found a Service Annotation: %v = %v", annotationKey, annotationValue)
+		klog.V(logLevelPayloads).Infof("Found a Service Annotation: %v = %v", annotationKey, annotationValue)
 		return annotationValue
 	}
 	//if there is no annotation, set "settings" var to the value from cloud config
-	klog.Infof("Could not find a Service Annotation:%s; falling back on default setting:%v", annotationKey, defaultSetting)
+	klog.V(logLevelPayloads).Infof("Could not find a Service Annotation:%s; falling back on default setting:%v", annotationKey, defaultSetting)
 	return defaultSetting
 }
 
-//getServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
+// getServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
 func getNodeAnnotation(node *v1.Node, annotationKey string, defaultSetting string) string {
-	klog.Infof("getNodeAnnotation(%v,%v,%v,%v)", node.Name, node.Annotations, annotationKey, defaultSetting)
+	klog.V(logLevelPayloads).Infof("getNodeAnnotation(%v,%v,%v)", node.Name, annotationKey, defaultSetting)
 	if annotationValue, ok := node.Annotations[annotationKey]; ok {
 		//if there is an annotation for this setting, set the "setting" var to it
 		// annotationValue can be empty, it is working as designed
 		// it makes possible for instance provisioning loadbalancer without floatingip
-		klog.Infof("Found a Node Annotation: %v = %v", annotationKey, annotationValue)
+		klog.V(logLevelPayloads).Infof("Found a Node Annotation: %v = %v", annotationKey, annotationValue)
 		return annotationValue
 	}
 	//if there is no annotation, set "settings" var to the value from cloud config
-	klog.Infof("Could not find a Node Annotation:%s; falling back on default setting:%v", annotationKey, defaultSetting)
+	klog.V(logLevelPayloads).Infof("Could not find a Node Annotation:%s; falling back on default setting:%v", annotationKey, defaultSetting)
 	return defaultSetting
 }
 
 // 返回service聚合的pods所在的nodes
-func getServiceNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
-	spec := service.Spec
-	if spec.Selector["app"] != "" {
-		sel := "app=" + spec.Selector["app"]
-		cmd1 := exec.Command("cat", "/var/run/secrets/kubernetes.io/serviceaccount/token")
-		res1, erro := cmd1.CombinedOutput()
-		if erro != nil {
-			klog.Errorf("cat /var/run/secrets/kubernetes.io/serviceaccount/token error:%v", erro)
-		}
-
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
-		podsUrl := fmt.Sprintf("https://kubernetes.default.svc.cluster.local/api/v1/namespaces/%s/pods/?labelSelector=%s", service.Namespace, sel)
-		req, err := http.NewRequest("GET", podsUrl, nil)
+// getServiceNodes returns the nodes to register as members of the listeners of service,
+// among the nodes kept by backendNodes.
+// With externalTrafficPolicy Cluster every node forwards to the endpoints through kube-proxy,
+// so every node is returned and the members do not change with the endpoints.
+// With Local, the nodes hosting the ready endpoints of service are returned, read from the
+// Endpoints informer. Endpoints are matched to nodes by nodeName, or by address for the
+// manual Endpoints of Services without selector; if some of them are not on any node, or
+// service has no ready endpoint at all, every node is returned, the health checks on the
+// healthCheckNodePort keep the traffic on the nodes hosting endpoints.
+// The core Endpoints are read rather than EndpointSlices: the vendored k8s.io/api and client-go
+// have no discovery/v1 types nor their informers, moving to them needs a client-go upgrade.
+func (ic *InCloud) getServiceNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	if isLocalTrafficPolicy(service) {
+		endpoints, err := ic.getServiceEndpoints(service)
 		if err != nil {
-			klog.Errorf("Request error %v", err)
-			return nil, err
+			return []*v1.Node{}, err
 		}
-		req.Header.Set("Content-Type", "text/plain")
-		req.Header.Set("Authorization", "Bearer "+string(res1))
-		res, err := client.Do(req)
-		if err != nil {
-			klog.Errorf("Response error %v", err)
-			return nil, err
-		}
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			klog.Errorf("Get response body fail %v", err)
-			return nil, err
+		// matched against every node, an endpoint on an excluded node is not outside the cluster
+		if hosting := endpointNodes(endpoints, nodes); len(hosting) > 0 {
+			nodes = hosting
+		} else {
+			klog.Infof("Service:%s/%s has no ready endpoints, registering every node", service.Namespace, service.Name)
 		}
-		if res.StatusCode != http.StatusOK {
-			klog.Errorf("response not ok:%v,%v", res.StatusCode, string(body))
-			return nil, fmt.Errorf("response not ok:%d", res.StatusCode)
+	}
+	return ic.backendNodes(service, nodes)
+}
+
+// getServiceEndpoints returns the Endpoints of service from the Endpoints informer, nil if it has none
+func (ic *InCloud) getServiceEndpoints(service *v1.Service) (*v1.Endpoints, error) {
+	if ic.endpointsInformer == nil || !ic.endpointsInformer.Informer().HasSynced() {
+		return nil, fmt.Errorf("endpoints of service:%s/%s are not synced yet", service.Namespace, service.Name)
+	}
+	endpoints, err := ic.endpointsInformer.Lister().Endpoints(service.Namespace).Get(service.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
 		}
+		return nil, err
+	}
+	return endpoints, nil
+}
 
-		var result v1.PodList
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			klog.Errorf("json.Unmarshal error:%s,output:%v", err, string(body))
-			return nil, err
+// endpointNodes returns the nodes of nodes hosting the ready addresses of endpoints
+func endpointNodes(endpoints *v1.Endpoints, nodes []*v1.Node) []*v1.Node {
+	if endpoints == nil {
+		return []*v1.Node{}
+	}
+	//正常情况下，nodes数量大于等于endpoints所在的nodes
+	//异常情况下，如node notready，接口传进来的nodes只有正常的nodes如slave2，少于endpoints所在的nodes
+	hosting := make(map[string]bool)
+	external := false
+	for _, subset := range endpoints.Subsets {
+		// NotReadyAddresses are left out
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil {
+				hosting[*addr.NodeName] = true
+			} else if node := findNodeByAddress(nodes, addr.IP); node != nil {
+				hosting[node.Name] = true
+			} else {
+				external = true
+			}
 		}
-		//正常情况下，nodes数量大于等于result.Items
-		//异常情况下，如node notready，接口传进来的nodes只有正常的nodes如slave2，少于result.Items的nodes数量
-		var retNodes = []*v1.Node{}
-		for _, item := range result.Items {
-			for _, node := range nodes {
-				if node.Name == item.Spec.NodeName {
-					retNodes = append(retNodes, node)
-					break
-				}
+	}
+	if external {
+		return nodes
+	}
+	var retNodes = []*v1.Node{}
+	for _, node := range nodes {
+		if hosting[node.Name] {
+			retNodes = append(retNodes, node)
+		}
+	}
+	return retNodes
+}
+
+// findNodeByAddress returns the node of nodes having the address ip, nil if none has it
+func findNodeByAddress(nodes []*v1.Node, ip string) *v1.Node {
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			if addr.Address == ip {
+				return node
 			}
 		}
-		return retNodes, nil
 	}
-	return nil, fmt.Errorf("service:%s/%s dosen't have selector(app)", service.Namespace, service.Name)
+	return nil
 }
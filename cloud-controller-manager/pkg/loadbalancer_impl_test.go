@@ -5,7 +5,13 @@ import (
 	. "github.com/agiledragon/gomonkey"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1lister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -15,12 +21,12 @@ func TestEnsureLoadBalancerDeleted1(t *testing.T) {
 	c := &InCloud{
 
 	}
-	patch1 := ApplyFunc(GetLoadBalancer, func(config *InCloud, service *v1.Service) (*LoadBalancer, error) {
+	patch1 := ApplyFunc(GetLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) (*LoadBalancer, error) {
 		return &LoadBalancer{
 			RegionId: "123",
 		}, nil
 	})
-	patch2 := ApplyFunc(GetListeners, func(config *InCloud, service *v1.Service) ([]Listener, error) {
+	patch2 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
 		return []Listener{
 			{SLBId: "1234"},
 		}, nil
@@ -30,12 +36,12 @@ func TestEnsureLoadBalancerDeleted1(t *testing.T) {
 			SLBId:"1",
 		}
 	})
-	patch4:=ApplyFunc(GetBackends,func (config *InCloud, slbid, listenerId string) ([]Backend, error) {
+	patch4:=ApplyFunc(GetBackends,func (ctx context.Context, config *InCloud, slbid, listenerId string) ([]Backend, error) {
 		return []Backend{
 			{BackendId:"11"},
 		},nil
 	})
-	patch5:=ApplyFunc(DeleteBackends,func (config *InCloud, slbid, listenerId string, backendIdList []string) error {
+	patch5:=ApplyFunc(DeleteBackends,func (ctx context.Context, config *InCloud, slbid, listenerId string, backendIdList []string) error {
 		return nil
 	})
 	defer patch1.Reset()
@@ -72,3 +78,590 @@ func TestEnsureLoadBalancer(t *testing.T) {
 	}
   c.EnsureLoadBalancer(context.TODO(),clusterName,ss,nn)
 }
+
+func TestProvisionLoadBalancer(t *testing.T) {
+	c := &InCloud{config: Config{SlbScheme: SchemeInternal}}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: types.UID("uid-1")},
+	}
+	if _, err := c.provisionLoadBalancer(context.TODO(), "kubernetes", service); !IsPermanentError(err) {
+		t.Fatalf("expected a permanent error without subnet, got %v", err)
+	}
+
+	created := 0
+	patch1 := ApplyFunc(FindLoadBalancersByName, func(ctx context.Context, config *InCloud, slbName string) ([]LoadBalancer, error) {
+		if slbName != "k8s-kubernetes-uid-1" {
+			t.Fatalf("unexpected SLB name %s", slbName)
+		}
+		return []LoadBalancer{
+			{SlbId: "slb-other", Tags: ownerTags("kubernetes", &v1.Service{})},
+			{SlbId: "slb-1", Tags: ownerTags("kubernetes", service)},
+		}, nil
+	})
+	patch2 := ApplyFunc(CreateLoadBalancer, func(ctx context.Context, config *InCloud, opts CreateLoadBalancerOpts) (*LoadBalancer, error) {
+		created++
+		return &LoadBalancer{SlbId: "slb-2"}, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+
+	c.config.SubnetID = "subnet-1"
+	// the SLB of a previous sync is reused, recording it fails without kubernetes client
+	_, err := c.provisionLoadBalancer(context.TODO(), "kubernetes", service)
+	if err == nil || !strings.Contains(err.Error(), "slb-1") || created != 0 {
+		t.Fatalf("expected the owned SLB to be reused, got %v after %d creations", err, created)
+	}
+}
+
+func TestEnsureLoadBalancerDeletedReleasesOwnedSLB(t *testing.T) {
+	c := &InCloud{config: Config{EipUrlPre: "https://eip"}}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: types.UID("uid-1"),
+			Annotations: map[string]string{"service.beta.kubernetes.io/inspur-load-balancer-slbid": "slb-1"}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}}},
+	}
+	owner, foreign := "", true
+	var deletedListeners []string
+	deleted, released := false, ""
+	patch1 := ApplyFunc(GetLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) (*LoadBalancer, error) {
+		return &LoadBalancer{SlbId: "slb-1", EipId: "eip-1", Tags: ownerTags(owner, service)}, nil
+	})
+	patch2 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		ls := []Listener{
+			{SLBId: "slb-1", ListenerId: "l-1", ListenerName: "listener_kubernetes_default_web_tcp_30080", Protocol: "TCP", Port: 30080},
+		}
+		if foreign {
+			ls = append(ls, Listener{SLBId: "slb-1", ListenerId: "l-2", ListenerName: "listener_kubernetes_default_api_tcp_30443", Protocol: "TCP", Port: 30443})
+		}
+		return ls, nil
+	})
+	patch3 := ApplyFunc(GetBackends, func(ctx context.Context, config *InCloud, slbid, listenerId string) ([]Backend, error) {
+		return nil, nil
+	})
+	patch4 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch5 := ApplyFunc(deleteListener, func(ctx context.Context, client *apiClient, url, token, slbId, listenerId string) error {
+		deletedListeners = append(deletedListeners, listenerId)
+		return nil
+	})
+	patch6 := ApplyFunc(DeleteLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) error {
+		deleted = true
+		return nil
+	})
+	patch7 := ApplyFunc(WaitLoadBalancerDeleted, func(ctx context.Context, config *InCloud, slbid string) error {
+		return nil
+	})
+	patch8 := ApplyFunc(ReleaseEip, func(ctx context.Context, config *InCloud, eipid string) error {
+		released = eipid
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+	defer patch6.Reset()
+	defer patch7.Reset()
+	defer patch8.Reset()
+
+	// an SLB given by the user only loses the listeners of the Service
+	owner = "other-cluster"
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedListeners) != 1 || deleted || released != "" {
+		t.Fatalf("user SLB modified: listeners %v, deleted %v, released %q", deletedListeners, deleted, released)
+	}
+
+	// an owned SLB still used by another Service only loses the listeners of the Service
+	deletedListeners = nil
+	owner = "kubernetes"
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedListeners) != 1 || deletedListeners[0] != "l-1" || deleted || released != "" {
+		t.Fatalf("shared SLB released: listeners %v, deleted %v, released %q", deletedListeners, deleted, released)
+	}
+
+	deletedListeners = nil
+	foreign = false
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedListeners) != 1 || !deleted || released != "eip-1" {
+		t.Fatalf("owned SLB not released: listeners %v, deleted %v, released %q", deletedListeners, deleted, released)
+	}
+}
+
+func TestEnsureLoadBalancerDeletedRetriesEipRelease(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: types.UID("uid-1"),
+			Annotations: map[string]string{"service.beta.kubernetes.io/inspur-load-balancer-slbid": "slb-1"}},
+	}
+	gone, deleted := false, 0
+	var releaseErr error
+	var released []string
+	patch1 := ApplyFunc(GetLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) (*LoadBalancer, error) {
+		if gone {
+			return nil, ErrorNotFoundInCloud
+		}
+		return &LoadBalancer{SlbId: "slb-1", EipId: "eip-1", EipAddress: "1.2.3.4", Tags: ownerTags("kubernetes", service)}, nil
+	})
+	patch2 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return nil, nil
+	})
+	patch3 := ApplyFunc(DeleteLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) error {
+		deleted++
+		gone = true
+		return nil
+	})
+	patch4 := ApplyFunc(WaitLoadBalancerDeleted, func(ctx context.Context, config *InCloud, slbid string) error {
+		return nil
+	})
+	patch5 := ApplyFunc(releaseEip, func(ctx context.Context, client *apiClient, url, token, eipId string) error {
+		released = append(released, eipId)
+		return releaseErr
+	})
+	patch6 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+	defer patch6.Reset()
+
+	// the SLB is not deleted while its EIP could not be released
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); !IsPermanentError(err) || deleted != 0 {
+		t.Fatalf("expected the missing eipUrl-pre to be reported before deleting, got %v after %d deletions", err, deleted)
+	}
+
+	c.config.EipUrlPre = "https://eip"
+	releaseErr = &APIError{Operation: "releaseEip", StatusCode: 500}
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err == nil || deleted != 1 {
+		t.Fatalf("expected the failed release to be reported, got %v after %d deletions", err, deleted)
+	}
+	// the SLB is gone, its EIP is still released by the next sync
+	releaseErr = nil
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(released, ",") != "eip-1,eip-1" || deleted != 1 {
+		t.Fatalf("unexpected releases %v after %d deletions", released, deleted)
+	}
+	if err := c.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil || len(released) != 2 {
+		t.Fatalf("EIP released again: %v, %v", released, err)
+	}
+}
+
+func TestEnsureLoadBalancerRecreatesReleasedSLB(t *testing.T) {
+	c := &InCloud{config: Config{SubnetID: "subnet-1", SlbScheme: SchemeInternal}}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: types.UID("uid-1"), Annotations: map[string]string{
+			"service.beta.kubernetes.io/inspur-load-balancer-slbid": "slb-1",
+			"loadbalancer.inspur.com/provisioned-slbid":             "slb-1",
+		}},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	created := 0
+	patch1 := ApplyFunc(GetLoadBalancer, func(ctx context.Context, config *InCloud, service *v1.Service) (*LoadBalancer, error) {
+		return nil, ErrorNotFoundInCloud
+	})
+	patch2 := ApplyFunc(FindLoadBalancersByName, func(ctx context.Context, config *InCloud, slbName string) ([]LoadBalancer, error) {
+		return nil, nil
+	})
+	patch3 := ApplyFunc(CreateLoadBalancer, func(ctx context.Context, config *InCloud, opts CreateLoadBalancerOpts) (*LoadBalancer, error) {
+		created++
+		return &LoadBalancer{SlbId: "slb-2"}, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+
+	if _, exists, err := c.GetLoadBalancer(context.TODO(), "kubernetes", service); exists || err != nil {
+		t.Fatalf("expected the released SLB not to exist, got %v, %v", exists, err)
+	}
+	// a new SLB is created, recording it fails without kubernetes client
+	if _, err := c.ensureLoadBalancer(context.TODO(), "kubernetes", service, nil); err == nil || !strings.Contains(err.Error(), "slb-2") || created != 1 {
+		t.Fatalf("expected a new SLB, got %v after %d creations", err, created)
+	}
+
+	// an slbid given by the user is not replaced
+	delete(service.Annotations, "loadbalancer.inspur.com/provisioned-slbid")
+	if _, err := c.ensureLoadBalancer(context.TODO(), "kubernetes", service, nil); !IsNotFoundError(err) || created != 1 {
+		t.Fatalf("expected the missing SLB to be reported, got %v after %d creations", err, created)
+	}
+}
+
+func TestEnsureListenersSkipsPortsOfOtherServices(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+			{Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP},
+			{Port: 8080, NodePort: 30808, Protocol: v1.ProtocolTCP},
+		}},
+	}
+	var created, updated []string
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_api_tcp_80", Protocol: "TCP", Port: 80},
+			{ListenerId: "l-2", ListenerName: "listener_kubernetes_default_web_tcp_443", Protocol: "TCP", Port: 443},
+		}, nil
+	})
+	patch2 := ApplyFunc(CreateListener, func(ctx context.Context, config *InCloud, opts CreateListenerOpts) (*Listener, error) {
+		created = append(created, opts.ListenerName)
+		return &Listener{ListenerId: "l-new"}, nil
+	})
+	patch3 := ApplyFunc(UpdateListener, func(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+		updated = append(updated, listenerid+"="+opts.ListenerName)
+		return &Listener{}, nil
+	})
+	patch4 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch5 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+
+	err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "listener_kubernetes_default_api_tcp_80") {
+		t.Fatalf("expected a port conflict, got %v", err)
+	}
+	// the listener of the Service is updated, the free port gets a new listener
+	if len(updated) != 1 || updated[0] != "l-2=listener_kubernetes_default_web_tcp_443" {
+		t.Fatalf("unexpected updates %v", updated)
+	}
+	if len(created) != 1 || created[0] != "listener_kubernetes_default_web_tcp_8080" {
+		t.Fatalf("unexpected creations %v", created)
+	}
+}
+
+func TestEnsureListenersDeletesStaleListeners(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Port: 80, NodePort: 30081, Protocol: v1.ProtocolTCP},
+		}},
+	}
+	var deletedBackends, deleted []string
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-0", ListenerName: "listener_kubernetes_default_web_tcp_80", Protocol: "TCP", Port: 80},
+			// listening on the NodePort, created by an older release
+			{ListenerId: "l-1", ListenerName: "listener_30081_1", Protocol: "TCP", Port: 30081},
+			// port removed from the Service
+			{ListenerId: "l-2", ListenerName: "listener_kubernetes_default_web_tcp_443", Protocol: "TCP", Port: 443},
+			{ListenerId: "l-3", ListenerName: "listener_kubernetes_default_api_tcp_8080", Protocol: "TCP", Port: 8080},
+			{ListenerId: "l-4", ListenerName: "listener_30909_1", Protocol: "TCP", Port: 30909},
+		}, nil
+	})
+	patch2 := ApplyFunc(UpdateListener, func(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+		return &Listener{}, nil
+	})
+	patch3 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch4 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		if backendPort != 30081 {
+			t.Errorf("members of %s registered on port %d", listener.ListenerId, backendPort)
+		}
+		return nil
+	})
+	patch5 := ApplyFunc(GetBackends, func(ctx context.Context, config *InCloud, slbid, listenerId string) ([]Backend, error) {
+		return []Backend{{BackendId: "b-" + listenerId}}, nil
+	})
+	patch6 := ApplyFunc(DeleteBackends, func(ctx context.Context, config *InCloud, slbid, listenerId string, backendIdList []string) error {
+		deletedBackends = append(deletedBackends, backendIdList...)
+		return nil
+	})
+	patch7 := ApplyMethod(reflect.TypeOf(&Listener{}), "DeleteListener", func(l *Listener, ctx context.Context, config *InCloud, slbid string) error {
+		if slbid != "slb-1" {
+			t.Errorf("listener %s deleted from SLB %s", l.ListenerId, slbid)
+		}
+		if l.ListenerId == "l-2" {
+			return &APIError{StatusCode: 500}
+		}
+		deleted = append(deleted, l.ListenerId)
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+	defer patch6.Reset()
+	defer patch7.Reset()
+
+	// the listener failing to be deleted is reported, the others are still deleted
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err == nil {
+		t.Fatal("expected the failed deletion to be reported")
+	}
+	// listeners of other Services and unadopted legacy listeners are kept
+	if strings.Join(deleted, ",") != "l-1" || strings.Join(deletedBackends, ",") != "b-l-1,b-l-2" {
+		t.Fatalf("unexpected deletions %v, backends %v", deleted, deletedBackends)
+	}
+}
+
+func TestEnsureListenersTCPAndUDPOnTheSamePort(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns", Annotations: map[string]string{
+			"loadbalancer.inspur.com/is-healthcheck":           "1",
+			"loadbalancer.inspur.com/healthcheck-type":         "http",
+			"loadbalancer.inspur.com/healthcheck-udp-request":  "ping",
+			"loadbalancer.inspur.com/healthcheck-udp-response": "pong",
+		}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Port: 53, NodePort: 30053, Protocol: v1.ProtocolTCP},
+			{Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+		}},
+	}
+	created := make(map[string]CreateListenerOpts)
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_dns_tcp_53", Protocol: "TCP", Port: 53},
+		}, nil
+	})
+	patch2 := ApplyFunc(CreateListener, func(ctx context.Context, config *InCloud, opts CreateListenerOpts) (*Listener, error) {
+		created[opts.ListenerName] = opts
+		return &Listener{ListenerId: "l-2"}, nil
+	})
+	patch3 := ApplyFunc(UpdateListener, func(ctx context.Context, config *InCloud, listenerid string, opts CreateListenerOpts) (*Listener, error) {
+		return &Listener{}, nil
+	})
+	patch4 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch5 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+	defer patch5.Reset()
+
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	opts, ok := created["listener_kubernetes_default_dns_udp_53"]
+	if len(created) != 1 || !ok {
+		t.Fatalf("expected a single UDP listener, got %v", created)
+	}
+	if opts.Protocol != ProtocolUDP || opts.TypeHealthCheck != "udp" || opts.PathHealthCheck != "" ||
+		opts.RequestHealthCheck != "ping" || opts.ResponseHealthCheck != "pong" {
+		t.Fatalf("unexpected UDP listener %+v", opts)
+	}
+
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Port: 5000, NodePort: 30500, Protocol: v1.ProtocolSCTP})
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); !IsPermanentError(err) {
+		t.Fatalf("expected SCTP to be rejected, got %v", err)
+	}
+}
+
+func TestEndpointNodes(t *testing.T) {
+	node := func(name, ip string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}}},
+		}
+	}
+	nodes := []*v1.Node{node("node-1", "10.0.0.1"), node("node-2", "10.0.0.2"), node("node-3", "10.0.0.3")}
+	name1, name3, gone := "node-1", "node-3", "node-4"
+	endpoints := &v1.Endpoints{Subsets: []v1.EndpointSubset{{
+		Addresses:         []v1.EndpointAddress{{IP: "172.16.0.1", NodeName: &name1}, {IP: "172.16.0.4", NodeName: &gone}},
+		NotReadyAddresses: []v1.EndpointAddress{{IP: "172.16.0.3", NodeName: &name3}},
+	}}}
+	if got := endpointNodes(endpoints, nodes); len(got) != 1 || got[0].Name != "node-1" {
+		t.Fatalf("expected the node of the ready endpoint, got %v", got)
+	}
+
+	// manual Endpoints of a Service without selector
+	manual := &v1.Endpoints{Subsets: []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}}}}
+	if got := endpointNodes(manual, nodes); len(got) != 1 || got[0].Name != "node-2" {
+		t.Fatalf("expected the node of the address, got %v", got)
+	}
+	manual.Subsets[0].Addresses = append(manual.Subsets[0].Addresses, v1.EndpointAddress{IP: "192.168.0.1"})
+	if got := endpointNodes(manual, nodes); len(got) != 3 {
+		t.Fatalf("expected every node for endpoints outside the cluster, got %v", got)
+	}
+}
+
+func TestEnsureListenersLocalTrafficPolicy(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+				{Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+			},
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+			HealthCheckNodePort:   32000,
+		},
+	}
+	created := make(map[string]CreateListenerOpts)
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return nil, nil
+	})
+	patch2 := ApplyFunc(CreateListener, func(ctx context.Context, config *InCloud, opts CreateListenerOpts) (*Listener, error) {
+		created[opts.ListenerName] = opts
+		return &Listener{ListenerId: opts.ListenerName}, nil
+	})
+	patch3 := ApplyFunc(GetListener, func(ctx context.Context, config *InCloud, service *v1.Service, listenerId string) (*Listener, error) {
+		return &Listener{ListenerId: listenerId}, nil
+	})
+	patch4 := ApplyFunc(UpdateBackends, func(ctx context.Context, config *InCloud, listener *Listener, backendPort int, backends interface{}, weights map[string]int) error {
+		return nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := created["listener_kubernetes_default_web_tcp_80"]
+	if tcp.IsHealthCheck != "1" || tcp.TypeHealthCheck != "http" || tcp.PortHealthCheck != 32000 || tcp.PathHealthCheck != "/healthz" {
+		t.Fatalf("expected the TCP listener to check the healthCheckNodePort, got %+v", tcp)
+	}
+	if udp := created["listener_kubernetes_default_web_udp_53"]; udp.TypeHealthCheck != "udp" {
+		t.Fatalf("expected the UDP listener to keep its UDP health check, got %+v", udp)
+	}
+
+	service.Spec.HealthCheckNodePort = 0
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); !IsPermanentError(err) {
+		t.Fatalf("expected a Service without healthCheckNodePort to be rejected, got %v", err)
+	}
+}
+
+func TestGetServiceNodesClusterTrafficPolicy(t *testing.T) {
+	// every node is a member, the endpoints are not read
+	c := &InCloud{}
+	service := &v1.Service{Spec: v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeCluster}}
+	ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Status: ready},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}, Status: ready},
+	}
+	got, err := c.getServiceNodes(service, nodes)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected every node, got %v, %v", got, err)
+	}
+
+	service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	if _, err := c.getServiceNodes(service, nodes); err == nil {
+		t.Fatal("expected the endpoints to be read with Local policy")
+	}
+}
+
+// fakeEndpointsInformer is an Endpoints informer listing endpoints, without API server
+type fakeEndpointsInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func newFakeEndpointsInformer(t *testing.T, stop <-chan struct{}, endpoints ...v1.Endpoints) *fakeEndpointsInformer {
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return &v1.EndpointsList{Items: endpoints}, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &v1.Endpoints{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	go informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		t.Fatal("endpoints not synced")
+	}
+	return &fakeEndpointsInformer{informer: informer}
+}
+
+func (i *fakeEndpointsInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i *fakeEndpointsInformer) Lister() corev1lister.EndpointsLister {
+	return corev1lister.NewEndpointsLister(i.informer.GetIndexer())
+}
+
+func TestGetServiceNodesLocalTrafficPolicyWithoutEndpoints(t *testing.T) {
+	ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Status: ready},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}, Status: ready},
+	}
+	node1 := "node-1"
+	stop := make(chan struct{})
+	defer close(stop)
+	c := &InCloud{endpointsInformer: newFakeEndpointsInformer(t, stop,
+		v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "172.16.0.1", NodeName: &node1}},
+		}}},
+		// scaled to zero
+		v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "idle"}},
+	)}
+	service := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+		}
+	}
+
+	if got, err := c.getServiceNodes(service("web"), nodes); err != nil || len(got) != 1 || got[0].Name != "node-1" {
+		t.Fatalf("expected the node of the endpoint, got %v, %v", got, err)
+	}
+	// every node is registered, the health checks drain them
+	for _, name := range []string{"idle", "missing"} {
+		if got, err := c.getServiceNodes(service(name), nodes); err != nil || len(got) != 2 {
+			t.Fatalf("expected every node for service %s without ready endpoints, got %v, %v", name, got, err)
+		}
+	}
+}
+
+func TestEnsureListenersKeepsListenerFailingToBeReplaced(t *testing.T) {
+	c := &InCloud{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{
+			"loadbalancer.inspur.com/protocol-port": "http:80",
+		}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+		}},
+	}
+	patch1 := ApplyFunc(GetListeners, func(ctx context.Context, config *InCloud, service *v1.Service) ([]Listener, error) {
+		return []Listener{
+			{ListenerId: "l-1", ListenerName: "listener_kubernetes_default_web_tcp_80", Protocol: "TCP", Port: 80},
+		}, nil
+	})
+	patch2 := ApplyFunc(GetBackends, func(ctx context.Context, config *InCloud, slbid, listenerId string) ([]Backend, error) {
+		return nil, nil
+	})
+	patch3 := ApplyMethod(reflect.TypeOf(&Listener{}), "DeleteListener", func(l *Listener, ctx context.Context, config *InCloud, slbid string) error {
+		return &APIError{Operation: "deleteListener", StatusCode: 500}
+	})
+	patch4 := ApplyFunc(CreateListener, func(ctx context.Context, config *InCloud, opts CreateListenerOpts) (*Listener, error) {
+		t.Errorf("listener %s created on the port of the listener failing to be deleted", opts.ListenerName)
+		return &Listener{}, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+	defer patch3.Reset()
+	defer patch4.Reset()
+
+	if err := c.ensureListeners(context.TODO(), "kubernetes", service, &LoadBalancer{SlbId: "slb-1"}, nil); err == nil {
+		t.Fatal("expected the failed replacement to be reported")
+	}
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	. "github.com/agiledragon/gomonkey"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -20,10 +21,10 @@ func TestGetLoadBalancer(t *testing.T) {
 	patch1:=ApplyFunc(getServiceAnnotation,func (service *v1.Service, annotationKey string, defaultSetting string) string {
 		return "123"
 	})
-	patch2:=ApplyFunc(getKeyCloakToken,func (requestedSubject, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (string, error) {
+	patch2:=ApplyFunc(getToken,func (ctx context.Context, config *InCloud) (string, error) {
 		return "",nil
 	})
-	patch3:=ApplyFunc( describeLoadBalancer,func(url, token, slbId string) (*LoadBalancer, error) {
+	patch3:=ApplyFunc( describeLoadBalancer,func(ctx context.Context, client *apiClient, url, token, slbId string) (*LoadBalancer, error) {
 		return &LoadBalancer{
 			RegionId:"1",
 			VpcId:"2",
@@ -32,7 +33,7 @@ func TestGetLoadBalancer(t *testing.T) {
 	defer patch1.Reset()
 	defer patch2.Reset()
 	defer patch3.Reset()
-	lb,err:=GetLoadBalancer(config,service)
+	lb,err:=GetLoadBalancer(context.TODO(),config,service)
 	if lb==nil||err!=nil{
 		t.Fatal("get load balancer failed")
 	}
@@ -44,17 +45,47 @@ func TestDeleteLoadBalancer(t *testing.T) {
 	patch1:=ApplyFunc(getServiceAnnotation,func (service *v1.Service, annotationKey string, defaultSetting string) string {
 		return "12"
 	})
-	patch2:=ApplyFunc(getKeyCloakToken,func (requestedSubject, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (string, error) {
+	patch2:=ApplyFunc(getToken,func (ctx context.Context, config *InCloud) (string, error) {
 		return "",nil
 	})
-	patch3:=ApplyFunc(deleteLoadBalancer,func (url, token, slbId string) error {
+	patch3:=ApplyFunc(deleteLoadBalancer,func (ctx context.Context, client *apiClient, url, token, slbId string) error {
 		return nil
 	})
 	defer patch1.Reset()
 	defer patch2.Reset()
 	defer patch3.Reset()
-	err := DeleteLoadBalancer(config,service)
+	err := DeleteLoadBalancer(context.TODO(),config,service)
 	if err !=nil{
 		t.Fatal(err)
 	}
-}
\ No newline at end of file
+}
+func TestWaitLoadBalancerActiveStopsOnPermanentErrors(t *testing.T) {
+	config := &InCloud{}
+	calls := 0
+	var lb *LoadBalancer
+	var describeErr error
+	patch1 := ApplyFunc(getToken, func(ctx context.Context, config *InCloud) (string, error) {
+		return "", nil
+	})
+	patch2 := ApplyFunc(describeLoadBalancer, func(ctx context.Context, client *apiClient, url, token, slbId string) (*LoadBalancer, error) {
+		calls++
+		return lb, describeErr
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+
+	describeErr = ErrorNotFoundInCloud
+	if _, err := WaitLoadBalancerActive(context.TODO(), config, "slb-1"); err != ErrorNotFoundInCloud || calls != 1 {
+		t.Fatalf("expected the missing SLB to be reported at once, got %v after %d calls", err, calls)
+	}
+
+	calls, lb, describeErr = 0, &LoadBalancer{SlbId: "slb-1", State: "ERROR"}, nil
+	if _, err := WaitLoadBalancerActive(context.TODO(), config, "slb-1"); !IsPermanentError(err) || calls != 1 {
+		t.Fatalf("expected the failed SLB to be reported at once, got %v after %d calls", err, calls)
+	}
+
+	calls, lb = 0, &LoadBalancer{SlbId: "slb-1", State: "active"}
+	if got, err := WaitLoadBalancerActive(context.TODO(), config, "slb-1"); err != nil || got.SlbId != "slb-1" {
+		t.Fatalf("expected the active SLB, got %v, %v", got, err)
+	}
+}
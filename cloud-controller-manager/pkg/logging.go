@@ -0,0 +1,95 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// klog verbosity of the request dumps, credentials are always redacted from them
+const (
+	// logLevelRequests logs the method and url of every keycloak and SLB request
+	logLevelRequests klog.Level = 4
+	// logLevelPayloads adds request and response bodies, as well as annotation lookups
+	logLevelPayloads klog.Level = 5
+	// logLevelHeaders adds request headers
+	logLevelHeaders klog.Level = 6
+)
+
+const redacted = "<redacted>"
+
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Auth-Token"}
+
+var sensitivePatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// bearer tokens anywhere in a message
+	{regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`), "${1}" + redacted},
+	// json fields, e.g. keycloak responses
+	{regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|clientSecret|secret_access_key|secretAccessKey|privateKey|private_key|password|token|kktoken)"\s*:\s*")[^"]*(")`), "${1}" + redacted + "${2}"},
+	// form and query values, e.g. keycloak requests
+	{regexp.MustCompile(`(?i)((?:^|[?&\s])(?:client_secret|refresh_token|access_token|subject_token|password|token)=)[^&\s]*`), "${1}" + redacted},
+}
+
+// redact masks tokens, secrets and passwords found in s
+func redact(s string) string {
+	for _, p := range sensitivePatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactHeaders returns a copy of h without credentials
+func redactHeaders(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	for _, k := range sensitiveHeaders {
+		if c.Get(k) != "" {
+			c.Set(k, redacted)
+		}
+	}
+	return c
+}
+
+// logRequest dumps req according to the klog verbosity
+func logRequest(operation string, req *http.Request) {
+	if !klog.V(logLevelRequests) {
+		return
+	}
+	klog.Infof("%s request: %s %s", operation, req.Method, redact(req.URL.String()))
+	if klog.V(logLevelHeaders) {
+		klog.Infof("%s request headers: %v", operation, redactHeaders(req.Header))
+	}
+	if klog.V(logLevelPayloads) && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			defer body.Close()
+			if b, err := ioutil.ReadAll(body); err == nil && len(b) > 0 {
+				klog.Infof("%s request body: %s", operation, redact(string(b)))
+			}
+		}
+	}
+}
+
+// logResponse dumps a response to a request of operation according to the klog verbosity
+func logResponse(operation string, statusCode int, body []byte) {
+	if klog.V(logLevelPayloads) {
+		klog.Infof("%s response: %d %s", operation, statusCode, redact(string(body)))
+	} else if klog.V(logLevelRequests) {
+		klog.Infof("%s response: %d", operation, statusCode)
+	}
+}
+
+// serviceKey identifies service in logs without dumping the object
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+
+	"gitserver/kubernetes/inspur-cloud-controller-manager/cloud-controller-manager/pkg/common"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// labels of the nodes never registered as members, whatever their value
+var excludedNodeLabels = []string{
+	"node.kubernetes.io/exclude-from-external-load-balancers",
+	// alpha label of the service controller
+	"alpha.service-controller.kubernetes.io/exclude-balancer",
+	"node-role.kubernetes.io/master",
+	"node-role.kubernetes.io/control-plane",
+}
+
+// backendNodes returns the nodes which may be registered as members of the listeners of service:
+// masters and nodes labelled with an excludedNodeLabels are left out, so are the nodes not matching
+// the backend-label annotation of service, and the NotReady and cordoned nodes unless the
+// cloud-config keeps them
+func (ic *InCloud) backendNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	selector, err := getBackendSelector(service)
+	if err != nil {
+		return nil, err
+	}
+	config := ic.currentConfig()
+	var backends = []*v1.Node{}
+	for _, node := range nodes {
+		if reason := nodeExclusion(node, selector, config); reason != "" {
+			klog.V(logLevelPayloads).Infof("Node %s is not a member of service:%s/%s: %s", node.Name, service.Namespace, service.Name, reason)
+			continue
+		}
+		backends = append(backends, node)
+	}
+	return backends, nil
+}
+
+// getBackendSelector returns the node selector of the backend-label annotation of service
+func getBackendSelector(service *v1.Service) (labels.Selector, error) {
+	value := getServiceAnnotation(service, common.ServiceAnnotationLBBackendLabel, "")
+	if value == "" {
+		return labels.Everything(), nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: %v", common.ServiceAnnotationLBBackendLabel, err)}
+	}
+	return selector, nil
+}
+
+// nodeExclusion returns why node cannot be a member, an empty string if it can
+func nodeExclusion(node *v1.Node, selector labels.Selector, config Config) string {
+	for _, label := range excludedNodeLabels {
+		if _, ok := node.Labels[label]; ok {
+			return fmt.Sprintf("labelled %s", label)
+		}
+	}
+	if !selector.Matches(labels.Set(node.Labels)) {
+		return fmt.Sprintf("not matching %s", selector)
+	}
+	if !config.KeepNotReadyNodes && !isNodeReady(node) {
+		return "not ready"
+	}
+	if !config.KeepUnschedulableNodes && node.Spec.Unschedulable {
+		return "cordoned"
+	}
+	return ""
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// getBackendWeights returns the weights of nodes as members of the listeners of service, by node name:
+// the backend-weight label of the node, or else the backend-weight annotation of service. With the
+// backend-weight-by-endpoints annotation, which needs externalTrafficPolicy Local, it is multiplied by
+// the ready endpoints of service on the node, up to maxBackendWeight.
+func (ic *InCloud) getBackendWeights(service *v1.Service, nodes []*v1.Node) (map[string]int, error) {
+	weight, err := parseBackendWeight(getServiceAnnotation(service, common.ServiceAnnotationLBBackendWeight, strconv.Itoa(defaultBackendWeight)))
+	if err != nil {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s: %v", common.ServiceAnnotationLBBackendWeight, err)}
+	}
+	value := getServiceAnnotation(service, common.ServiceAnnotationLBWeightByEndpoints, "false")
+	byEndpoints, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s must be true or false, got %q",
+			common.ServiceAnnotationLBWeightByEndpoints, value)}
+	}
+	if byEndpoints && !isLocalTrafficPolicy(service) {
+		// with Cluster, kube-proxy spreads the traffic of every member over all the endpoints
+		return nil, &InvalidServiceError{Reason: fmt.Sprintf("annotation %s needs externalTrafficPolicy Local",
+			common.ServiceAnnotationLBWeightByEndpoints)}
+	}
+	var counts map[string]int
+	if byEndpoints {
+		endpoints, err := ic.getServiceEndpoints(service)
+		if err != nil {
+			return nil, err
+		}
+		if endpoints != nil {
+			counts = endpointCounts(endpoints, nodes)
+		}
+	}
+
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		w := weight
+		if label, ok := node.Labels[common.NodeLabelBackendWeight]; ok {
+			if w, err = parseBackendWeight(label); err != nil {
+				klog.Warningf("Ignoring label %s of node %s: %v", common.NodeLabelBackendWeight, node.Name, err)
+				w = weight
+			}
+		}
+		// nodes without endpoints are members only when some endpoints are outside the cluster
+		if count := counts[node.Name]; count > 1 {
+			w *= count
+			if w > maxBackendWeight {
+				w = maxBackendWeight
+			}
+		}
+		weights[node.Name] = w
+	}
+	return weights, nil
+}
+
+func parseBackendWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < minBackendWeight || weight > maxBackendWeight {
+		return 0, fmt.Errorf("weight must be an integer from %d to %d, got %q", minBackendWeight, maxBackendWeight, value)
+	}
+	return weight, nil
+}
+
+// endpointCounts returns the number of ready addresses of endpoints on each of nodes, by node name
+func endpointCounts(endpoints *v1.Endpoints, nodes []*v1.Node) map[string]int {
+	counts := make(map[string]int)
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil {
+				counts[*addr.NodeName]++
+			} else if node := findNodeByAddress(nodes, addr.IP); node != nil {
+				counts[node.Name]++
+			}
+		}
+	}
+	return counts
+}
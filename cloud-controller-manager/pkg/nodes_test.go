@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackendNodes(t *testing.T) {
+	node := func(name string, labels map[string]string, ready v1.ConditionStatus, unschedulable bool) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+			Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}}},
+		}
+	}
+	nodes := []*v1.Node{
+		node("worker-1", map[string]string{"pool": "web"}, v1.ConditionTrue, false),
+		node("worker-2", map[string]string{"pool": "batch"}, v1.ConditionTrue, false),
+		node("master", map[string]string{"node-role.kubernetes.io/master": ""}, v1.ConditionTrue, false),
+		node("excluded", map[string]string{"node.kubernetes.io/exclude-from-external-load-balancers": "true"}, v1.ConditionTrue, false),
+		node("not-ready", nil, v1.ConditionUnknown, false),
+		node("cordoned", nil, v1.ConditionTrue, true),
+	}
+	names := func(nodes []*v1.Node) []string {
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Name)
+		}
+		return names
+	}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{}}}
+
+	tests := []struct {
+		name     string
+		config   Config
+		selector string
+		expected []string
+	}{
+		{"defaults", Config{}, "", []string{"worker-1", "worker-2"}},
+		{"node pool", Config{}, "pool=web", []string{"worker-1"}},
+		{"keep not ready", Config{KeepNotReadyNodes: true}, "", []string{"worker-1", "worker-2", "not-ready"}},
+		{"keep cordoned", Config{KeepUnschedulableNodes: true}, "", []string{"worker-1", "worker-2", "cordoned"}},
+	}
+	for _, test := range tests {
+		c := &InCloud{config: test.config}
+		service.Annotations["loadbalancer.inspur.com/backend-label"] = test.selector
+		got, err := c.backendNodes(service, nodes)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if g := names(got); strings.Join(g, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, g)
+		}
+	}
+
+	service.Annotations["loadbalancer.inspur.com/backend-label"] = "pool in (web"
+	if _, err := (&InCloud{}).backendNodes(service, nodes); !IsPermanentError(err) {
+		t.Fatalf("expected an invalid selector to be rejected, got %v", err)
+	}
+}
+
+func TestGetBackendWeights(t *testing.T) {
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2", Labels: map[string]string{"loadbalancer.inspur.com/backend-weight": "40"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3", Labels: map[string]string{"loadbalancer.inspur.com/backend-weight": "heavy"}}},
+	}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{}}}
+	c := &InCloud{}
+
+	weights, err := c.getBackendWeights(service, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights["node-1"] != 10 || weights["node-2"] != 40 || weights["node-3"] != 10 {
+		t.Fatalf("unexpected default weights %v", weights)
+	}
+
+	service.Annotations["loadbalancer.inspur.com/backend-weight"] = "20"
+	if weights, _ = c.getBackendWeights(service, nodes); weights["node-1"] != 20 || weights["node-2"] != 40 {
+		t.Fatalf("unexpected weights %v", weights)
+	}
+
+	for _, invalid := range []string{"0", "101", "x"} {
+		service.Annotations["loadbalancer.inspur.com/backend-weight"] = invalid
+		if _, err := c.getBackendWeights(service, nodes); !IsPermanentError(err) {
+			t.Errorf("expected weight %q to be rejected, got %v", invalid, err)
+		}
+	}
+
+	// endpoints do not matter to the traffic of the members with externalTrafficPolicy Cluster
+	service.Annotations["loadbalancer.inspur.com/backend-weight"] = "10"
+	service.Annotations["loadbalancer.inspur.com/backend-weight-by-endpoints"] = "true"
+	if _, err := c.getBackendWeights(service, nodes); !IsPermanentError(err) {
+		t.Errorf("expected weights by endpoints to be rejected without Local policy, got %v", err)
+	}
+}
+
+func TestEndpointCounts(t *testing.T) {
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}, Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.2"}}}},
+	}
+	name1 := "node-1"
+	endpoints := &v1.Endpoints{Subsets: []v1.EndpointSubset{
+		{Addresses: []v1.EndpointAddress{{IP: "172.16.0.1", NodeName: &name1}, {IP: "172.16.0.2", NodeName: &name1}}},
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "172.16.0.3", NodeName: &name1}},
+		},
+	}}
+	counts := endpointCounts(endpoints, nodes)
+	if len(counts) != 2 || counts["node-1"] != 2 || counts["node-2"] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
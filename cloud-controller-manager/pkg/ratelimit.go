@@ -0,0 +1,124 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRateLimitQPS      = 10
+	defaultRateLimitBurst    = 20
+	defaultSlbRateLimitQPS   = 5
+	defaultSlbRateLimitBurst = 10
+
+	// slbLimiterIdle is the minimum time a per SLB limiter is kept unused, SLBs are not
+	// listed so that those deleted, or not used anymore by the Services, are forgotten
+	slbLimiterIdle = 10 * time.Minute
+)
+
+var rateLimitWaitSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Subsystem: "incloud_api",
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time requests to keycloak and the SLB API waited for the client side rate limiter.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"operation"},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitWaitSeconds)
+}
+
+// rateLimiter throttles the requests sent to the Inspur API with token buckets:
+// one shared by all requests and one per SLB, so that a burst of reconciliations
+// neither trips the API throttling nor lets a single SLB starve the others.
+type rateLimiter struct {
+	global *rate.Limiter
+
+	slbQPS    rate.Limit
+	slbBurst  int
+	mu        sync.Mutex
+	slbs      map[string]*slbLimiter
+	lastSweep time.Time
+}
+
+type slbLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+func newRateLimiter(config Config) *rateLimiter {
+	return &rateLimiter{
+		global:   rate.NewLimiter(rate.Limit(config.RateLimitQPS), config.RateLimitBurst),
+		slbQPS:   rate.Limit(config.SlbRateLimitQPS),
+		slbBurst: config.SlbRateLimitBurst,
+		slbs:     make(map[string]*slbLimiter),
+	}
+}
+
+// Wait blocks until a request of operation on slbId may be sent, or ctx is done.
+// slbId is empty for requests which are not bound to a SLB.
+func (r *rateLimiter) Wait(ctx context.Context, operation, slbId string) error {
+	start := time.Now()
+	defer func() {
+		rateLimitWaitSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}()
+	if slbId != "" {
+		if err := r.forSLB(slbId).Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return r.global.Wait(ctx)
+}
+
+func (r *rateLimiter) forSLB(slbId string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.evictIdle(now)
+	limiter, ok := r.slbs[slbId]
+	if !ok {
+		limiter = &slbLimiter{Limiter: rate.NewLimiter(r.slbQPS, r.slbBurst)}
+		r.slbs[slbId] = limiter
+	}
+	limiter.lastUsed = now
+	return limiter.Limiter
+}
+
+// evictIdle drops the limiters of the SLBs without requests for idleTimeout. Their bucket
+// is full again by then, a new limiter throttles the next requests the same way.
+func (r *rateLimiter) evictIdle(now time.Time) {
+	idle := r.idleTimeout()
+	if now.Sub(r.lastSweep) < idle {
+		return
+	}
+	r.lastSweep = now
+	for slbId, limiter := range r.slbs {
+		if now.Sub(limiter.lastUsed) >= idle {
+			delete(r.slbs, slbId)
+		}
+	}
+}
+
+// idleTimeout returns the time a per SLB limiter is kept unused, at least the time its bucket
+// takes to fill up
+func (r *rateLimiter) idleTimeout() time.Duration {
+	if r.slbQPS <= 0 {
+		// never refilled
+		return time.Duration(math.MaxInt64)
+	}
+	if refill := time.Duration(float64(r.slbBurst) / float64(r.slbQPS) * float64(time.Second)); refill > slbLimiterIdle {
+		return refill
+	}
+	return slbLimiterIdle
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPerSLB(t *testing.T) {
+	r := newRateLimiter(Config{RateLimitQPS: 1000, RateLimitBurst: 100, SlbRateLimitQPS: 0.001, SlbRateLimitBurst: 1})
+
+	if err := r.Wait(context.TODO(), "describeLoadBalancer", "slb-1"); err != nil {
+		t.Fatal(err)
+	}
+	// the bucket of slb-1 is empty, other SLBs are not affected
+	if err := r.Wait(context.TODO(), "describeLoadBalancer", "slb-2"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx, "describeLoadBalancer", "slb-1"); err == nil {
+		t.Fatal("expected slb-1 to be throttled")
+	}
+}
+
+func TestRateLimiterDefaults(t *testing.T) {
+	config := Config{}
+	config.applyDefaults()
+	r := newRateLimiter(config)
+	if r.global.Limit() != defaultRateLimitQPS || r.global.Burst() != defaultRateLimitBurst {
+		t.Fatalf("unexpected global limiter %v/%d", r.global.Limit(), r.global.Burst())
+	}
+	if r.slbQPS != defaultSlbRateLimitQPS || r.slbBurst != defaultSlbRateLimitBurst {
+		t.Fatalf("unexpected slb limiter %v/%d", r.slbQPS, r.slbBurst)
+	}
+}
+
+func TestRateLimiterEvictsIdleSLBs(t *testing.T) {
+	r := newRateLimiter(Config{RateLimitQPS: 1000, RateLimitBurst: 100, SlbRateLimitQPS: 5, SlbRateLimitBurst: 10})
+	for _, slbId := range []string{"slb-1", "slb-2"} {
+		if err := r.Wait(context.TODO(), "describeLoadBalancer", slbId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// slb-1 is deleted, slb-2 still used
+	r.slbs["slb-1"].lastUsed = time.Now().Add(-slbLimiterIdle)
+	r.lastSweep = time.Now().Add(-slbLimiterIdle)
+	if err := r.Wait(context.TODO(), "describeLoadBalancer", "slb-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.slbs["slb-1"]; ok || len(r.slbs) != 1 {
+		t.Fatalf("expected the limiter of slb-1 to be evicted, got %v", r.slbs)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/fsnotify.v1"
+	"k8s.io/klog"
+)
+
+var configReloadsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "incloud",
+		Name:      "config_reloads_total",
+		Help:      "Reloads of the cloud-config file by result: applied or rejected.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(configReloadsTotal)
+}
+
+// watchCloudConfig reloads the cloud-config at path whenever it changes. The directory
+// is watched rather than the file, because ConfigMap and Secret volumes replace their
+// files by swapping a symlink.
+func (ic *InCloud) watchCloudConfig(path string, stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("Failed to watch cloud config %s, changes need a restart: %v", path, err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		klog.Errorf("Failed to watch cloud config %s, changes need a restart: %v", path, err)
+		watcher.Close()
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case event := <-watcher.Events:
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				ic.reloadCloudConfig(path)
+			case err := <-watcher.Errors:
+				klog.Errorf("Watching cloud config %s: %v", path, err)
+			}
+		}
+	}()
+}
+
+// reloadCloudConfig reads the cloud-config at path and applies it if it is valid,
+// otherwise the current settings are kept
+func (ic *InCloud) reloadCloudConfig(path string) {
+	config, err := LoadCloudCfg(path)
+	if err == nil {
+		var changed bool
+		changed, err = ic.applyConfig(config)
+		if err == nil {
+			if changed {
+				configReloadsTotal.WithLabelValues("applied").Inc()
+				klog.Infof("Reloaded cloud config %s: %v", path, config)
+			}
+			return
+		}
+	}
+	configReloadsTotal.WithLabelValues("rejected").Inc()
+	klog.Errorf("Rejected cloud config %s, keeping the current settings: %v", path, err)
+}
+
+// applyConfig swaps the endpoints, http client, auth provider and credentials of ic for
+// those of config. Reconciliations pick the new settings on their next request.
+// It returns false if config is the one in use.
+func (ic *InCloud) applyConfig(config Config) (bool, error) {
+	old := ic.currentConfig()
+	if config == old {
+		return false, nil
+	}
+	if config.SecretNamespace != old.SecretNamespace || config.SecretName != old.SecretName ||
+		config.SecretClientSecretKey != old.SecretClientSecretKey || config.SecretTokenKey != old.SecretTokenKey ||
+		config.SecretSecretAccessKeyKey != old.SecretSecretAccessKeyKey {
+		return false, fmt.Errorf("changing the credentials secret needs a restart")
+	}
+
+	if withoutCredentials(config) == withoutCredentials(old) {
+		ic.cfgMu.Lock()
+		ic.config = config
+		ic.cfgMu.Unlock()
+	} else {
+		apiClient, err := newAPIClient(config)
+		if err != nil {
+			return false, err
+		}
+		auth, err := newAuthProvider(ic, config)
+		if err != nil {
+			return false, err
+		}
+		apiClient.auth = auth
+
+		ic.cfgMu.Lock()
+		previous := ic.apiClient
+		ic.config = config
+		ic.LbUrlPre = config.SlbUrlPre
+		ic.KeycloakUrl = config.KeycloakUrl
+		ic.TokenClientID = config.TokenClientID
+		ic.RequestedSubject = config.RequestedSubject
+		ic.apiClient = apiClient
+		ic.auth = auth
+		ic.cfgMu.Unlock()
+
+		// requests in flight keep their connections, idle ones are not reused anymore
+		if previous != nil {
+			if tr, ok := previous.httpClient.Transport.(*http.Transport); ok {
+				tr.CloseIdleConnections()
+			}
+		}
+	}
+
+	if config.SecretName == "" {
+		// otherwise the credentials come from the secret, which is still watched
+		ic.setCredentials(cloudCredentials{
+			ClientSecret:    config.ClientSecret,
+			KeycloakToken:   config.KeycloakToken,
+			SecretAccessKey: config.SecretAccessKey,
+		})
+	}
+	return true, nil
+}
+
+// withoutCredentials returns config without the settings which are swapped through setCredentials
+func withoutCredentials(config Config) Config {
+	config.ClientSecret = ""
+	config.KeycloakToken = ""
+	config.SecretAccessKey = ""
+	return config
+}
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadCloudConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloud-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cloud-config")
+	if err := ioutil.WriteFile(path, []byte(testCloudConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadCloudCfg(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud, err := newInCloud(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := cloud.(*InCloud)
+	client, auth := getAPIClient(ic), ic.authProvider()
+
+	// a rotated secret only swaps the credentials
+	rotated := strings.Replace(testCloudConfig, `"s3cr3t;#"`, "rotated", 1)
+	ioutil.WriteFile(path, []byte(rotated), 0600)
+	ic.reloadCloudConfig(path)
+	if ic.credentials().ClientSecret != "rotated" || getAPIClient(ic) != client || ic.authProvider() != auth {
+		t.Fatalf("expected only the credentials to change")
+	}
+
+	// a new endpoint swaps the client
+	moved := strings.Replace(rotated, "https://slb.example.com", "https://slb2.example.com", 1)
+	ioutil.WriteFile(path, []byte(moved), 0600)
+	ic.reloadCloudConfig(path)
+	if ic.slbUrlPre() != "https://slb2.example.com/slb/v1/slbs" || getAPIClient(ic) == client || ic.authProvider() == auth {
+		t.Fatalf("endpoint not swapped: %s", ic.slbUrlPre())
+	}
+
+	// invalid files are rejected
+	ioutil.WriteFile(path, []byte("[Global]\nslbUrl-pre = https://slb3.example.com\n"), 0600)
+	ic.reloadCloudConfig(path)
+	if ic.slbUrlPre() != "https://slb2.example.com/slb/v1/slbs" || ic.credentials().ClientSecret != "rotated" {
+		t.Fatalf("invalid config applied: %s", ic.slbUrlPre())
+	}
+
+	// the secret is only watched from Initialize
+	ioutil.WriteFile(path, []byte(moved+"secret-name = incloud\n"), 0600)
+	ic.reloadCloudConfig(path)
+	if ic.currentConfig().SecretName != "" {
+		t.Fatal("expected a change of secret to be rejected")
+	}
+}
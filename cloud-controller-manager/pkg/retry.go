@@ -0,0 +1,74 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultRetryMaxAttempts  = 4
+	defaultRetryInitialDelay = 500  //milliseconds
+	defaultRetryMaxDelay     = 8000 //milliseconds
+)
+
+func (c Config) retryBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: time.Duration(c.RetryInitialDelay) * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    c.RetryMaxAttempts,
+		Cap:      time.Duration(c.RetryMaxDelay) * time.Millisecond,
+	}
+}
+
+// shouldRetry returns true if req failed with err and may be sent again.
+// Idempotent requests are retried on any retryable error. Creations are only
+// retried when the API cannot have acted on them, i.e. when they were throttled
+// or the connection could not be established; other failures of a creation are
+// left to the next reconciliation, which looks the resource up before creating it.
+func shouldRetry(operation string, req *http.Request, err error) bool {
+	if !IsRetryableError(err) {
+		return false
+	}
+	if isIdempotent(operation, req) {
+		return true
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func isIdempotent(operation string, req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	// token requests have no side effect
+	return operation == "postKeycloakForm"
+}
+
+// sleepWithContext waits for d, or returns the error of ctx if it is done first
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
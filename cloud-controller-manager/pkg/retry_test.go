@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func newTestAPIClient(maxAttempts int) *apiClient {
+	return &apiClient{
+		httpClient:  http.DefaultClient,
+		maxAttempts: maxAttempts,
+		backoff:     wait.Backoff{Duration: time.Millisecond, Factor: 2, Jitter: 0.5, Steps: maxAttempts},
+	}
+}
+
+func TestDoRequestRetriesIdempotentRequests(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("{}"))
+	body, err := doRequest(context.TODO(), newTestAPIClient(4), "modifyListener", "slb-1", req, http.StatusOK)
+	if err != nil || string(body) != "ok" || calls != 3 {
+		t.Fatalf("got %q, %v after %d calls", body, err, calls)
+	}
+}
+
+func TestDoRequestDoesNotRetryCreation(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("{}"))
+	_, err := doRequest(context.TODO(), newTestAPIClient(4), "createListener", "slb-1", req, http.StatusOK)
+	// the throttled attempt is retried, the bad gateway may have created the listener
+	if !IsRetryableError(err) || calls != 2 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoRequestHonorsContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := newTestAPIClient(10)
+	client.backoff.Duration = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := doRequest(ctx, client, "describeLoadBalancer", "slb-1", req, http.StatusOK); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to stop retries, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 inspur Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// minTokenRefreshWindow is the minimum time before expiry at which a cached token is renewed
+	minTokenRefreshWindow = 30 * time.Second
+)
+
+var ErrorTokenSourceNotInitialized = errors.New("auth provider is not initialized")
+
+// keycloakGrant requests a new token from keycloak with the client secret currently in use
+type keycloakGrant func(ctx context.Context, ic *InCloud, clientSecret string) (*keycloakToken, error)
+
+// keycloakTokenSource caches the access token issued by keycloak and renews it
+// shortly before it expires, preferring the refresh token over a new grant.
+// It is shared by all SLB calls of an InCloud and is safe for concurrent use:
+// callers arriving while a renewal is in flight wait for it and reuse its result.
+type keycloakTokenSource struct {
+	ic    *InCloud
+	grant keycloakGrant
+	now   func() time.Time
+
+	mu            sync.Mutex
+	token         *keycloakToken
+	expiry        time.Time
+	refreshExpiry time.Time
+}
+
+func newKeycloakTokenSource(ic *InCloud, grant keycloakGrant) *keycloakTokenSource {
+	return &keycloakTokenSource{ic: ic, grant: grant, now: time.Now}
+}
+
+// tokenExchangeGrant exchanges the token of the requested subject for a token of audience
+func tokenExchangeGrant(audience string) keycloakGrant {
+	return func(ctx context.Context, ic *InCloud, clientSecret string) (*keycloakToken, error) {
+		keycloakUrl, tokenClientID, requestedSubject := ic.keycloakClient()
+		return getKeyCloakToken(ctx, requestedSubject, tokenClientID, clientSecret, keycloakUrl, audience, ic)
+	}
+}
+
+// clientCredentialsGrant authenticates as the service account of the token client
+func clientCredentialsGrant(ctx context.Context, ic *InCloud, clientSecret string) (*keycloakToken, error) {
+	keycloakUrl, tokenClientID, _ := ic.keycloakClient()
+	return getClientCredentialsToken(ctx, tokenClientID, clientSecret, keycloakUrl, ic)
+}
+
+// Token returns a valid bearer token, renewing the cached one when needed
+func (ts *keycloakTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := ts.now()
+	if ts.token != nil && now.Before(ts.expiry) {
+		return "Bearer " + ts.token.AccessToken, nil
+	}
+
+	clientSecret := ts.ic.credentials().ClientSecret
+	var token *keycloakToken
+	var err error
+	if ts.token != nil && ts.token.RefreshToken != "" && now.Before(ts.refreshExpiry) {
+		keycloakUrl, tokenClientID, _ := ts.ic.keycloakClient()
+		token, err = refreshKeyCloakToken(ctx, ts.token.RefreshToken, tokenClientID, clientSecret, keycloakUrl, ts.ic)
+		if err != nil {
+			klog.Warningf("refresh keycloak token failed, falling back to a new grant: %v", err)
+		}
+	}
+	if token == nil {
+		token, err = ts.grant(ctx, ts.ic, clientSecret)
+		if err != nil {
+			return "", err
+		}
+	}
+	ts.setToken(token, now)
+	return "Bearer " + ts.token.AccessToken, nil
+}
+
+// Sign does nothing, the token is sent in the Authorization header
+func (ts *keycloakTokenSource) Sign(req *http.Request) error {
+	return nil
+}
+
+// Invalidate drops the cached token so the next call to Token requests a new one
+func (ts *keycloakTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = nil
+}
+
+// setToken caches token and computes the instants after which the access and
+// refresh tokens must be renewed. Renewal happens ahead of the real expiry, at
+// a tenth of the lifetime but no less than minTokenRefreshWindow, so that a
+// request never leaves with a token about to expire.
+func (ts *keycloakTokenSource) setToken(token *keycloakToken, issued time.Time) {
+	ts.token = token
+	ts.expiry = issued.Add(renewAfter(token.ExpiresIn))
+	ts.refreshExpiry = time.Time{}
+	if token.RefreshToken != "" {
+		if token.RefreshExpiresIn > 0 {
+			ts.refreshExpiry = issued.Add(renewAfter(token.RefreshExpiresIn))
+		} else {
+			// keycloak reports 0 for offline refresh tokens, which do not expire
+			ts.refreshExpiry = issued.Add(100 * 365 * 24 * time.Hour)
+		}
+	}
+}
+
+func renewAfter(expiresIn int32) time.Duration {
+	lifetime := time.Duration(expiresIn) * time.Second
+	window := lifetime / 10
+	if window < minTokenRefreshWindow {
+		window = minTokenRefreshWindow
+	}
+	if lifetime <= window {
+		return 0
+	}
+	return lifetime - window
+}
+
+// getToken returns the value of the Authorization header of the SLB API calls of config
+func getToken(ctx context.Context, config *InCloud) (string, error) {
+	auth := config.authProvider()
+	if auth == nil {
+		return "", ErrorTokenSourceNotInitialized
+	}
+	return auth.Token(ctx)
+}
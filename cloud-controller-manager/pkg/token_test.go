@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+)
+
+func TestKeycloakTokenSourceCachesAndRefreshes(t *testing.T) {
+	exchanges, refreshes := 0, 0
+	patch1 := ApplyFunc(getKeyCloakToken, func(ctx context.Context, requestedSubject, tokenClientId, clientSecret, keycloakUrl, audience string, ic *InCloud) (*keycloakToken, error) {
+		exchanges++
+		return &keycloakToken{AccessToken: "exchanged", ExpiresIn: 300, RefreshExpiresIn: 1800, RefreshToken: "r1"}, nil
+	})
+	patch2 := ApplyFunc(refreshKeyCloakToken, func(ctx context.Context, refreshToken, tokenClientId, clientSecret, keycloakUrl string, ic *InCloud) (*keycloakToken, error) {
+		refreshes++
+		if refreshToken != "r1" {
+			t.Fatalf("unexpected refresh token %s", refreshToken)
+		}
+		return &keycloakToken{AccessToken: "refreshed", ExpiresIn: 300, RefreshExpiresIn: 1800, RefreshToken: "r2"}, nil
+	})
+	defer patch1.Reset()
+	defer patch2.Reset()
+
+	now := time.Unix(1000, 0)
+	ts := newKeycloakTokenSource(&InCloud{}, tokenExchangeGrant(defaultAudience))
+	ts.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		token, err := ts.Token(context.TODO())
+		if err != nil || token != "Bearer exchanged" {
+			t.Fatalf("got %q, %v", token, err)
+		}
+	}
+	if exchanges != 1 || refreshes != 0 {
+		t.Fatalf("expected a single exchange, got %d exchanges and %d refreshes", exchanges, refreshes)
+	}
+
+	// inside the renewal window the refresh token is used
+	now = now.Add(275 * time.Second)
+	token, err := ts.Token(context.TODO())
+	if err != nil || token != "Bearer refreshed" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+	if exchanges != 1 || refreshes != 1 {
+		t.Fatalf("expected a refresh, got %d exchanges and %d refreshes", exchanges, refreshes)
+	}
+
+	// once the refresh token is expired a new exchange is needed
+	now = now.Add(time.Hour)
+	if _, err := ts.Token(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 2 {
+		t.Fatalf("expected a second exchange, got %d", exchanges)
+	}
+}
+
+func TestKeycloakTokenSourceSerializesRenewal(t *testing.T) {
+	var mu sync.Mutex
+	exchanges := 0
+	patch1 := ApplyFunc(getKeyCloakToken, func(ctx context.Context, requestedSubject, tokenClientId, clientSecret, keycloakUrl, audience string, ic *InCloud) (*keycloakToken, error) {
+		mu.Lock()
+		exchanges++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return &keycloakToken{AccessToken: "a", ExpiresIn: 300}, nil
+	})
+	defer patch1.Reset()
+
+	ts := newKeycloakTokenSource(&InCloud{}, tokenExchangeGrant(defaultAudience))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ts.Token(context.TODO()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if exchanges != 1 {
+		t.Fatalf("expected concurrent callers to share one exchange, got %d", exchanges)
+	}
+}